@@ -2,6 +2,7 @@ package main
 
 import (
 	"log/slog"
+	"os"
 
 	"github.com/PhilippHeuer/dotfiles-cli/pkg/cmd"
 )
@@ -22,9 +23,12 @@ func init() {
 	cmd.RepositoryStatus = status
 }
 
+//go:generate go run . schema --output dotfiles.schema.json
+
 // CLI Main Entrypoint
 func main() {
 	if err := cmd.Execute(); err != nil {
 		slog.Error("cli error", "err", err)
+		os.Exit(1)
 	}
 }
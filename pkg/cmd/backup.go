@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/dotfiles"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+	"github.com/spf13/cobra"
+)
+
+func backupCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "manage backups of files replaced during install",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	cmd.AddCommand(backupListCmd())
+	cmd.AddCommand(backupRestoreCmd())
+
+	return cmd
+}
+
+func backupListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "list all backups",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			state, err := loadState(storeFromFlags(cmd))
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 1, 1, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "TARGET\tCREATED\tBACKUP")
+			for _, b := range state.Backups {
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", b.Target, b.CreatedAt.Local().Format(time.DateTime), b.Path)
+			}
+			_ = w.Flush()
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func backupRestoreCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore <target>...",
+		Short: "restore the most recent backup of the given targets",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// properties
+			force, _ := cmd.Flags().GetBool("force")
+			home, _ := cmd.Flags().GetString("home")
+
+			store := storeFromFlags(cmd)
+			state, err := loadState(store)
+			if err != nil {
+				return err
+			}
+
+			var errs []error
+			for _, arg := range args {
+				target, err := filepath.Abs(util.ExpandPath(arg, home))
+				if err != nil {
+					errs = append(errs, fmt.Errorf("failed to resolve target %s: %w", arg, err))
+					continue
+				}
+
+				backup, err := dotfiles.RestoreBackup(store, state, target, force)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				slog.Info("restored backup", "target", target, "created", backup.CreatedAt)
+			}
+
+			// save state
+			if err := store.SaveState(state); err != nil {
+				errs = append(errs, &dotfiles.StateError{File: store.StateFile, Err: err})
+			}
+
+			return errors.Join(errs...)
+		},
+	}
+
+	cmd.PersistentFlags().Bool("force", false, "replace the target even if it exists and is not managed")
+
+	return cmd
+}
+
+// loadState loads the state file from the store
+func loadState(store *config.Store) (*config.DotfileState, error) {
+	if err := util.CreateParentDirectory(store.FS, store.StateFile); err != nil {
+		return nil, &dotfiles.StateError{File: store.StateFile, Err: err}
+	}
+	state, err := store.LoadState()
+	if err != nil {
+		return nil, &dotfiles.StateError{File: store.StateFile, Err: err}
+	}
+
+	return state, nil
+}
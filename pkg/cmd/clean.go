@@ -1,12 +1,9 @@
 package cmd
 
 import (
-	"log/slog"
 	"os"
 
-	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
 	"github.com/PhilippHeuer/dotfiles-cli/pkg/dotfiles"
-	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
 	"github.com/spf13/cobra"
 )
 
@@ -14,36 +11,50 @@ func cleanCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "clean",
 		Short: "clean dotfiles",
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			// properties
 			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			format, _ := cmd.Flags().GetString("format")
+			home, _ := cmd.Flags().GetString("home")
 
 			// load state
-			stateFile := config.StateFile()
-			if err := util.CreateParentDirectory(stateFile); err != nil {
-				slog.Error("failed to create state directory", "file", stateFile, "err", err)
-				os.Exit(1)
+			store := storeFromFlags(cmd)
+			state, err := loadState(store)
+			if err != nil {
+				return err
 			}
-			state, err := config.LoadState(stateFile)
+
+			// managed files of the selected directories
+			selected, other, err := dotfiles.SelectManagedFiles(state, selectionFromFlags(cmd), home)
 			if err != nil {
-				slog.Error("failed to parse state file", "file", stateFile, "err", err)
-				os.Exit(1)
+				return err
+			}
+
+			// dry run only prints the plan
+			if dryRun {
+				plan := dotfiles.DeletePlan(store.FS, selected)
+				if format == "json" {
+					return plan.PrintJSON(os.Stdout)
+				}
+				plan.Print(os.Stdout)
+				return nil
 			}
 
 			// remove files
-			state.ManagedFiles = dotfiles.DeleteManagedFiles(state.ManagedFiles, dryRun)
+			state.ManagedFiles = append(dotfiles.DeleteManagedFiles(store, state, selected, dryRun), other...)
 
 			// save state
-			if !dryRun {
-				if saveErr := config.SaveState(stateFile, state); saveErr != nil {
-					slog.Error("failed to save state", "err", saveErr)
-					os.Exit(1)
-				}
+			if err := store.SaveState(state); err != nil {
+				return &dotfiles.StateError{File: store.StateFile, Err: err}
 			}
+
+			return nil
 		},
 	}
 
+	addSelectionFlags(cmd)
 	cmd.PersistentFlags().BoolP("dry-run", "d", false, "dry run")
+	cmd.PersistentFlags().StringP("format", "f", "text", "dry run plan output format - allowed: text,json")
 
 	return cmd
 }
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/dotfiles"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+	"github.com/spf13/cobra"
+)
+
+// addContextFlags registers the flags used to select the theme and extend the rule context
+func addContextFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("mode", "", "copy or symlink (defaults to the mode of the last install, or copy)")
+	cmd.PersistentFlags().String("theme", "", "theme to install (overrides DOTFILE_THEME env var)")
+	cmd.PersistentFlags().String("profile", "", "profile to install (defaults to the profile of the last install)")
+	cmd.PersistentFlags().String("context-file", "", "path to a key=value context file")
+	cmd.PersistentFlags().StringSlice("context", []string{}, "additional context key=value pairs")
+	cmd.PersistentFlags().String("unknown-keys", config.UnknownKeysError, "handling of unknown keys in dotfiles.yaml - allowed: error,warn")
+}
+
+// addSelectionFlags registers the flags used to limit a command to some directories
+func addSelectionFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringSlice("only", []string{}, "only include directories with one of these names, paths or tags")
+	cmd.PersistentFlags().StringSlice("skip", []string{}, "skip directories with one of these names, paths or tags")
+}
+
+// selectionFromFlags returns the selection of --only and --skip
+func selectionFromFlags(cmd *cobra.Command) dotfiles.Selection {
+	only, _ := cmd.Flags().GetStringSlice("only")
+	skip, _ := cmd.Flags().GetStringSlice("skip")
+
+	return dotfiles.Selection{Only: only, Skip: skip}
+}
+
+// contextFromFlags builds the extra rule context from --context-file and --context
+func contextFromFlags(cmd *cobra.Command) (map[string]interface{}, error) {
+	extraContext := make(map[string]interface{})
+	contextFile, _ := cmd.Flags().GetString("context-file")
+	if contextFile != "" {
+		fileCtx, err := util.LoadContextFile(util.ResolvePath(contextFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load context file %s: %w", contextFile, err)
+		}
+		for k, v := range fileCtx {
+			extraContext[k] = v
+		}
+	}
+	contextPairs, _ := cmd.Flags().GetStringSlice("context")
+	for _, pair := range contextPairs {
+		k, v, found := strings.Cut(pair, "=")
+		if !found {
+			slog.Warn("skipping malformed context pair", "value", pair)
+			continue
+		}
+		extraContext[strings.TrimSpace(k)] = util.ParseContextValue(strings.TrimSpace(v))
+	}
+
+	return extraContext, nil
+}
+
+// storeFromFlags returns the state store on the filesystem selected by --root and --home
+func storeFromFlags(cmd *cobra.Command) *config.Store {
+	root, _ := cmd.Flags().GetString("root")
+	home, _ := cmd.Flags().GetString("home")
+
+	return dotfiles.Options{Root: root, Home: home}.Store()
+}
+
+// installerOptions builds the installer options from the flags registered by addContextFlags
+func installerOptions(cmd *cobra.Command, args []string) (dotfiles.Options, error) {
+	mode, _ := cmd.Flags().GetString("mode")
+	theme, _ := cmd.Flags().GetString("theme")
+	profile, _ := cmd.Flags().GetString("profile")
+	root, _ := cmd.Flags().GetString("root")
+	home, _ := cmd.Flags().GetString("home")
+	unknownKeys, _ := cmd.Flags().GetString("unknown-keys")
+
+	dir := ""
+	if len(args) == 1 && args[0] != "" {
+		dir = args[0]
+	}
+
+	extraContext, err := contextFromFlags(cmd)
+	if err != nil {
+		return dotfiles.Options{}, err
+	}
+
+	selection := selectionFromFlags(cmd)
+
+	return dotfiles.Options{
+		Source:      dir,
+		Mode:        mode,
+		Theme:       theme,
+		Profile:     profile,
+		Only:        selection.Only,
+		Skip:        selection.Skip,
+		Context:     extraContext,
+		Output:      os.Stdout,
+		Input:       os.Stdin,
+		Root:        root,
+		Home:        home,
+		UnknownKeys: unknownKeys,
+	}, nil
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/dotfiles"
+	"github.com/spf13/cobra"
+)
+
+func diffCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff",
+		Short: "show unified diffs of the changes install would make",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts, err := installerOptions(cmd, args)
+			if err != nil {
+				return err
+			}
+
+			// diff
+			diff, err := dotfiles.NewInstaller(opts).Diff()
+			if err != nil {
+				return err
+			}
+			fmt.Print(diff)
+
+			return nil
+		},
+	}
+
+	addContextFlags(cmd)
+	addSelectionFlags(cmd)
+
+	return cmd
+}
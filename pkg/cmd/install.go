@@ -1,11 +1,10 @@
 package cmd
 
 import (
-	"log/slog"
 	"strings"
 
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
 	"github.com/PhilippHeuer/dotfiles-cli/pkg/dotfiles"
-	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
 	"github.com/spf13/cobra"
 )
 
@@ -13,52 +12,30 @@ func installCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "install",
 		Short: "install dotfiles",
-		Run: func(cmd *cobra.Command, args []string) {
-			// properties
-			mode, _ := cmd.Flags().GetString("mode")
-			dryRun, _ := cmd.Flags().GetBool("dry-run")
-			theme, _ := cmd.Flags().GetString("theme")
-
-			dir := ""
-			if len(args) == 1 && args[0] != "" {
-				dir = args[0]
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts, err := installerOptions(cmd, args)
+			if err != nil {
+				return err
 			}
 
-			// extra context from CLI flags
-			extraContext := make(map[string]interface{})
-			contextFile, _ := cmd.Flags().GetString("context-file")
-			if contextFile != "" {
-				fileCtx, err := util.LoadContextFile(util.ResolvePath(contextFile))
-				if err != nil {
-					slog.Error("failed to load context file", "file", contextFile, "err", err)
-				} else {
-					for k, v := range fileCtx {
-						extraContext[k] = v
-					}
-				}
-			}
-			contextPairs, _ := cmd.Flags().GetStringSlice("context")
-			for _, pair := range contextPairs {
-				k, v, found := strings.Cut(pair, "=")
-				if !found {
-					slog.Warn("skipping malformed context pair", "value", pair)
-					continue
-				}
-				extraContext[strings.TrimSpace(k)] = util.ParseContextValue(strings.TrimSpace(v))
-			}
+			// properties
+			opts.Conflict, _ = cmd.Flags().GetString("conflict")
+			opts.DryRun, _ = cmd.Flags().GetBool("dry-run")
+			opts.Diff, _ = cmd.Flags().GetBool("diff")
+			opts.Format, _ = cmd.Flags().GetString("format")
 
 			// install
-			if err := dotfiles.Install(dir, mode, dryRun, extraContext, theme); err != nil {
-				slog.Error("failed to install dotfiles", "err", err)
-			}
+			_, err = dotfiles.NewInstaller(opts).Install()
+			return err
 		},
 	}
 
-	cmd.PersistentFlags().String("mode", "copy", "copy or symlink")
+	addContextFlags(cmd)
+	addSelectionFlags(cmd)
+	cmd.PersistentFlags().String("conflict", "skip", "policy for existing unmanaged targets - allowed: "+strings.Join(config.ConflictPolicies, ","))
 	cmd.PersistentFlags().BoolP("dry-run", "d", false, "dry run")
-	cmd.PersistentFlags().String("theme", "", "theme to install (overrides DOTFILE_THEME env var)")
-	cmd.PersistentFlags().String("context-file", "", "path to a key=value context file")
-	cmd.PersistentFlags().StringSlice("context", []string{}, "additional context key=value pairs")
+	cmd.PersistentFlags().Bool("diff", false, "print unified diffs of pending changes before installing")
+	cmd.PersistentFlags().StringP("format", "f", "text", "dry run plan output format - allowed: text,json")
 
 	return cmd
 }
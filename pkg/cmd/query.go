@@ -1,14 +1,15 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
-	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"text/tabwriter"
 
 	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/dotfiles"
 	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
 	"github.com/iancoleman/strcase"
 	"github.com/spf13/cobra"
@@ -18,29 +19,21 @@ func queryCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "query",
 		Short: "query the application config or state",
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) == 0 {
-				slog.Error("provide a key to query")
-				os.Exit(1)
+				return errors.New("provide a key to query")
 			}
 
 			// load state
-			stateFile := config.StateFile()
-			if err := util.CreateParentDirectory(stateFile); err != nil {
-				slog.Error("failed to create state directory", "file", stateFile, "err", err)
-				os.Exit(1)
-			}
-			state, err := config.LoadState(stateFile)
+			state, err := loadState(storeFromFlags(cmd))
 			if err != nil {
-				slog.Error("failed to parse state file", "file", stateFile, "err", err)
-				os.Exit(1)
+				return err
 			}
 
 			// load config
 			conf, err := config.Load(filepath.Join(state.Source, "dotfiles.yaml"), true)
 			if err != nil {
-				slog.Error("failed to parse config file", "file", filepath.Join(state.Source, "config.yaml"), "err", err)
-				os.Exit(1)
+				return &dotfiles.ConfigError{File: filepath.Join(state.Source, "dotfiles.yaml"), Err: err}
 			}
 
 			// check if the key is a property
@@ -52,12 +45,25 @@ func queryCmd() *cobra.Command {
 					_, _ = fmt.Fprintln(w, theme.Name)
 				}
 				_ = w.Flush()
+			case "profiles":
+				w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+				for _, profile := range conf.Profiles {
+					_, _ = fmt.Fprintln(w, profile.Name)
+				}
+				_ = w.Flush()
+			case "profile":
+				if state.Profile == "" {
+					return errors.New("active profile not set")
+				}
+				fmt.Println(state.Profile)
 			case "themeoverview":
-				requireActiveTheme(state)
 				at := state.ActiveTheme
 				if len(args) == 2 && args[1] != "" {
 					at = conf.GetTheme(args[1])
 				}
+				if at == nil {
+					return errors.New("active theme not set")
+				}
 
 				w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
 				_, _ = fmt.Fprintln(w, "Name\t"+at.Name)
@@ -72,31 +78,49 @@ func queryCmd() *cobra.Command {
 			case "source":
 				fmt.Println(state.Source)
 			case "theme":
-				requireActiveTheme(state)
+				if err := requireActiveTheme(state); err != nil {
+					return err
+				}
 				fmt.Println(state.ActiveTheme.Name)
 			case "colorscheme":
-				requireActiveTheme(state)
+				if err := requireActiveTheme(state); err != nil {
+					return err
+				}
 				fmt.Println(state.ActiveTheme.ColorScheme)
 			case "wallpaperdir":
-				requireActiveTheme(state)
+				if err := requireActiveTheme(state); err != nil {
+					return err
+				}
 				fmt.Println(util.ResolvePath(state.ActiveTheme.WallpaperDir))
 			case "fontfamily":
-				requireActiveTheme(state)
+				if err := requireActiveTheme(state); err != nil {
+					return err
+				}
 				fmt.Println(state.ActiveTheme.FontFamily)
 			case "fontsize":
-				requireActiveTheme(state)
+				if err := requireActiveTheme(state); err != nil {
+					return err
+				}
 				fmt.Println(state.ActiveTheme.FontSize)
 			case "gtktheme":
-				requireActiveTheme(state)
+				if err := requireActiveTheme(state); err != nil {
+					return err
+				}
 				fmt.Println(state.ActiveTheme.GtkTheme)
 			case "icontheme":
-				requireActiveTheme(state)
+				if err := requireActiveTheme(state); err != nil {
+					return err
+				}
 				fmt.Println(state.ActiveTheme.IconTheme)
 			case "cursortheme":
-				requireActiveTheme(state)
+				if err := requireActiveTheme(state); err != nil {
+					return err
+				}
 				fmt.Println(state.ActiveTheme.CursorTheme)
 			case "properties":
-				requireActiveTheme(state)
+				if err := requireActiveTheme(state); err != nil {
+					return err
+				}
 				for k, v := range state.ActiveTheme.Properties {
 					fmt.Println(k + "\t" + v)
 				}
@@ -105,23 +129,24 @@ func queryCmd() *cobra.Command {
 					for k, v := range state.ActiveTheme.Properties {
 						if strings.ToLower(strcase.ToCamel(k)) == key {
 							fmt.Println(v)
-							break
+							return nil
 						}
 					}
 				}
 
-				slog.Error("property not found", "key", key)
-				os.Exit(1)
+				return fmt.Errorf("property not found: %s", key)
 			}
+
+			return nil
 		},
 	}
 
 	return cmd
 }
 
-func requireActiveTheme(state *config.DotfileState) {
+func requireActiveTheme(state *config.DotfileState) error {
 	if state.ActiveTheme == nil {
-		slog.Error("active theme not set")
-		os.Exit(1)
+		return errors.New("active theme not set")
 	}
+	return nil
 }
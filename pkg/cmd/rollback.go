@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/dotfiles"
+	"github.com/spf13/cobra"
+)
+
+func rollbackCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rollback [generation]",
+		Short: "restore the managed files of an earlier install generation (default: previous)",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id := 0
+			if len(args) == 1 {
+				v, err := strconv.Atoi(args[0])
+				if err != nil || v <= 0 {
+					return fmt.Errorf("generation must be a positive number: %s", args[0])
+				}
+				id = v
+			}
+
+			g, err := dotfiles.Rollback(storeFromFlags(cmd), id)
+			if err != nil {
+				return err
+			}
+			slog.Info("restored generation", "generation", g.ID, "theme", g.Theme, "files", len(g.ManagedFiles))
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func generationsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "generations",
+		Short: "list install generations",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store := storeFromFlags(cmd)
+			state, err := loadState(store)
+			if err != nil {
+				return err
+			}
+			generations, err := store.ListGenerations()
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 1, 1, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "GENERATION\tCREATED\tPROFILE\tTHEME\tFILES\tCOMMIT\tDESCRIPTION")
+			for _, g := range generations {
+				id := strconv.Itoa(g.ID)
+				if g.ID == state.Generation {
+					id += " (current)"
+				}
+				commit := g.SourceCommit
+				if len(commit) > 12 {
+					commit = commit[:12]
+				}
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", id, g.CreatedAt.Local().Format(time.DateTime), g.Profile, g.Theme, len(g.ManagedFiles), commit, g.Description)
+			}
+			_ = w.Flush()
+
+			return nil
+		},
+	}
+
+	return cmd
+}
@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"os"
 	"strings"
 
 	"github.com/cidverse/cidverseutils/zerologconfig"
@@ -17,19 +16,29 @@ func rootCmd() *cobra.Command {
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
 			zerologconfig.Configure(cfg)
 		},
-		Args: cobra.MinimumNArgs(0),
-		Run: func(cmd *cobra.Command, args []string) {
-			_ = cmd.Help()
-			os.Exit(0)
+		Args:          cobra.MinimumNArgs(0),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
 		},
 	}
 
 	cmd.PersistentFlags().StringVar(&cfg.LogLevel, "log-level", "info", "log level - allowed: "+strings.Join(zerologconfig.ValidLogLevels, ","))
 	cmd.PersistentFlags().StringVar(&cfg.LogFormat, "log-format", "color", "log format - allowed: "+strings.Join(zerologconfig.ValidLogFormats, ","))
 	cmd.PersistentFlags().BoolVar(&cfg.LogCaller, "log-caller", false, "include caller in log functions")
+	cmd.PersistentFlags().String("root", "", "install below this directory instead of the filesystem root, theme commands are skipped")
+	cmd.PersistentFlags().String("home", "", "home directory used for ~ and $HOME in targets, templates and rules (default $HOME)")
 
 	cmd.AddCommand(installCmd())
+	cmd.AddCommand(statusCmd())
+	cmd.AddCommand(diffCmd())
+	cmd.AddCommand(validateCmd())
 	cmd.AddCommand(cleanCmd())
+	cmd.AddCommand(backupCmd())
+	cmd.AddCommand(generationsCmd())
+	cmd.AddCommand(rollbackCmd())
+	cmd.AddCommand(schemaCmd())
 	cmd.AddCommand(queryCmd())
 	cmd.AddCommand(versionCmd())
 
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+func schemaCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schema",
+		Short: "print the JSON Schema of dotfiles.yaml",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// properties
+			output, _ := cmd.Flags().GetString("output")
+
+			data, err := json.MarshalIndent(config.JSONSchema(), "", "  ")
+			if err != nil {
+				return err
+			}
+			data = append(data, '\n')
+
+			if output != "" {
+				return os.WriteFile(output, data, 0644)
+			}
+			fmt.Print(string(data))
+			return nil
+		},
+	}
+
+	cmd.PersistentFlags().StringP("output", "o", "", "write the schema to a file instead of stdout")
+
+	return cmd
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/dotfiles"
+	"github.com/spf13/cobra"
+)
+
+func statusCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "show drift between the managed files and the configuration",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts, err := installerOptions(cmd, args)
+			if err != nil {
+				return err
+			}
+
+			// properties
+			all, _ := cmd.Flags().GetBool("all")
+			format, _ := cmd.Flags().GetString("format")
+
+			// status
+			entries, err := dotfiles.NewInstaller(opts).Status()
+			if err != nil {
+				return err
+			}
+			if !all {
+				var filtered []dotfiles.StatusEntry
+				for _, e := range entries {
+					if e.Status != dotfiles.StatusOK {
+						filtered = append(filtered, e)
+					}
+				}
+				entries = filtered
+			}
+
+			// output
+			switch format {
+			case "json":
+				if entries == nil {
+					entries = []dotfiles.StatusEntry{}
+				}
+				data, _ := json.MarshalIndent(entries, "", "  ")
+				fmt.Println(string(data))
+			default:
+				if len(entries) == 0 {
+					fmt.Println("all managed files are up to date")
+					return nil
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 1, 1, 2, ' ', 0)
+				_, _ = fmt.Fprintln(w, "STATUS\tTARGET\tDETAIL")
+				for _, e := range entries {
+					_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", e.Status, e.Target, e.Detail)
+				}
+				_ = w.Flush()
+			}
+
+			return nil
+		},
+	}
+
+	addContextFlags(cmd)
+	addSelectionFlags(cmd)
+	cmd.PersistentFlags().BoolP("all", "a", false, "include files that are up to date")
+	cmd.PersistentFlags().StringP("format", "f", "text", "output format - allowed: text,json")
+
+	return cmd
+}
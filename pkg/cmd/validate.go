@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/dotfiles"
+	"github.com/spf13/cobra"
+)
+
+func validateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "validate [dir]",
+		Short: "check the configuration and all includes for problems without installing anything",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts, err := installerOptions(cmd, args)
+			if err != nil {
+				return err
+			}
+
+			// properties
+			format, _ := cmd.Flags().GetString("format")
+
+			// validate
+			problems, err := dotfiles.NewInstaller(opts).Validate()
+			if err != nil {
+				return err
+			}
+
+			// output
+			errorCount := 0
+			for _, p := range problems {
+				if p.Severity == config.SeverityError {
+					errorCount++
+				}
+			}
+			switch format {
+			case "json":
+				if problems == nil {
+					problems = []config.Problem{}
+				}
+				data, _ := json.MarshalIndent(problems, "", "  ")
+				fmt.Println(string(data))
+			default:
+				for _, p := range problems {
+					fmt.Println(p.String())
+				}
+				if len(problems) == 0 {
+					fmt.Println("configuration is valid")
+				} else {
+					fmt.Printf("%d error(s), %d warning(s)\n", errorCount, len(problems)-errorCount)
+				}
+			}
+
+			if errorCount > 0 {
+				return fmt.Errorf("configuration has %d error(s)", errorCount)
+			}
+			return nil
+		},
+	}
+
+	addContextFlags(cmd)
+	cmd.PersistentFlags().StringP("format", "f", "text", "output format - allowed: text,json")
+
+	return cmd
+}
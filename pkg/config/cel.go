@@ -0,0 +1,340 @@
+package config
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/overloads"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+var (
+	stringListType    = reflect.TypeOf([]string{})
+	stringMapType     = reflect.TypeOf(map[string]string{})
+	versionRegex      = regexp.MustCompile(`\d+(\.\d+)+`)
+	versionPartsRegex = regexp.MustCompile(`\d+(\.\d+)*`)
+
+	// cmdVersions caches the versions detected by cmdVersion for the lifetime of the process
+	cmdVersions   = make(map[string]string)
+	cmdVersionsMu sync.Mutex
+)
+
+// cmdVersionTimeout limits how long cmdVersion waits for `<name> --version`
+const cmdVersionTimeout = 5 * time.Second
+
+// RuleOptions configures how the functions of rules access the system
+type RuleOptions struct {
+	FS util.FS // filesystem checked by fileExists and dirExists, the OS if nil
+}
+
+// celFunctions returns the functions available in rules, conditions and variable expressions.
+// Paths are expanded with the home directory of the context and checked on the filesystem of the options, hostMatches uses the hostname of the context.
+func celFunctions(ctx RuleContext, opts RuleOptions) []cel.EnvOption {
+	fsys := opts.FS
+	if fsys == nil {
+		fsys = util.OSFS{}
+	}
+	home, _ := ctx["home"].(string)
+	hostname, ok := ctx["hostname"].(string)
+	if !ok {
+		hostname, _ = os.Hostname()
+	}
+
+	return []cel.EnvOption{
+		cel.Function(overloads.Contains,
+			cel.Overload("string_contains_string",
+				[]*cel.Type{cel.StringType, cel.StringType},
+				cel.BoolType,
+				cel.BinaryBinding(func(lhs, rhs ref.Val) ref.Val {
+					return types.Bool(strings.Contains(string(lhs.(types.String)), string(rhs.(types.String))))
+				}),
+			),
+			cel.Overload("stringslice_contains_string",
+				[]*cel.Type{cel.ListType(cel.StringType), cel.StringType},
+				cel.BoolType,
+				cel.BinaryBinding(func(lhs, rhs ref.Val) ref.Val {
+					list, err := lhs.ConvertToNative(stringListType)
+					if err != nil {
+						return types.NewErr("%s", err.Error())
+					}
+					return types.Bool(slices.Contains(list.([]string), string(rhs.(types.String))))
+				}),
+			),
+		),
+		cel.Function("containsKey",
+			cel.Overload("containsKey_map",
+				[]*cel.Type{cel.MapType(cel.StringType, cel.StringType), cel.StringType},
+				cel.BoolType,
+				cel.BinaryBinding(func(lhs, rhs ref.Val) ref.Val {
+					m, err := lhs.ConvertToNative(stringMapType)
+					if err != nil {
+						return types.NewErr("%s", err.Error())
+					}
+					_, ok := m.(map[string]string)[string(rhs.(types.String))]
+					return types.Bool(ok)
+				}),
+			),
+		),
+		cel.Function("getMapValue",
+			cel.Overload("getMapValue_map",
+				[]*cel.Type{cel.MapType(cel.StringType, cel.StringType), cel.StringType},
+				cel.StringType,
+				cel.BinaryBinding(func(lhs, rhs ref.Val) ref.Val {
+					m, err := lhs.ConvertToNative(stringMapType)
+					if err != nil {
+						return types.NewErr("%s", err.Error())
+					}
+					return types.String(m.(map[string]string)[string(rhs.(types.String))])
+				}),
+			),
+		),
+		cel.Function("hasPrefix",
+			cel.Overload("hasPrefix_string",
+				[]*cel.Type{cel.StringType, cel.StringType},
+				cel.BoolType,
+				cel.BinaryBinding(func(lhs, rhs ref.Val) ref.Val {
+					return types.Bool(strings.HasPrefix(string(lhs.(types.String)), string(rhs.(types.String))))
+				}),
+			),
+		),
+		cel.Function("inPath",
+			cel.Overload("inPath",
+				[]*cel.Type{cel.StringType},
+				cel.BoolType,
+				cel.UnaryBinding(func(name ref.Val) ref.Val {
+					_, err := exec.LookPath(string(name.(types.String)))
+					return types.Bool(err == nil)
+				}),
+			),
+		),
+		cel.Function("regex",
+			cel.Overload("regex_string",
+				[]*cel.Type{cel.StringType, cel.StringType},
+				cel.BoolType,
+				cel.BinaryBinding(func(lhs, rhs ref.Val) ref.Val {
+					matched, err := regexp.MatchString(string(rhs.(types.String)), string(lhs.(types.String)))
+					if err != nil {
+						return types.NewErr("%s", err.Error())
+					}
+					return types.Bool(matched)
+				}),
+			),
+		),
+		cel.Function("fileExists",
+			cel.Overload("fileExists_string",
+				[]*cel.Type{cel.StringType},
+				cel.BoolType,
+				cel.UnaryBinding(func(p ref.Val) ref.Val {
+					info, err := fsys.Stat(util.ExpandPath(string(p.(types.String)), home))
+					return types.Bool(err == nil && !info.IsDir())
+				}),
+			),
+		),
+		cel.Function("dirExists",
+			cel.Overload("dirExists_string",
+				[]*cel.Type{cel.StringType},
+				cel.BoolType,
+				cel.UnaryBinding(func(p ref.Val) ref.Val {
+					info, err := fsys.Stat(util.ExpandPath(string(p.(types.String)), home))
+					return types.Bool(err == nil && info.IsDir())
+				}),
+			),
+		),
+		cel.Function("env",
+			cel.Overload("env_string",
+				[]*cel.Type{cel.StringType},
+				cel.StringType,
+				cel.UnaryBinding(func(name ref.Val) ref.Val {
+					return types.String(os.Getenv(string(name.(types.String))))
+				}),
+			),
+		),
+		cel.Function("hostMatches",
+			cel.Overload("hostMatches_string",
+				[]*cel.Type{cel.StringType},
+				cel.BoolType,
+				cel.UnaryBinding(func(pattern ref.Val) ref.Val {
+					matched, err := path.Match(string(pattern.(types.String)), hostname)
+					if err != nil {
+						return types.NewErr("invalid host pattern: %s", err.Error())
+					}
+					return types.Bool(matched)
+				}),
+			),
+		),
+		cel.Function("cmdVersion",
+			cel.Overload("cmdVersion_string",
+				[]*cel.Type{cel.StringType},
+				cel.StringType,
+				cel.UnaryBinding(func(name ref.Val) ref.Val {
+					return types.String(cmdVersion(string(name.(types.String))))
+				}),
+			),
+		),
+		cel.Function("semverGte",
+			cel.Overload("semverGte_string_string",
+				[]*cel.Type{cel.StringType, cel.StringType},
+				cel.BoolType,
+				cel.BinaryBinding(func(lhs, rhs ref.Val) ref.Val {
+					v := string(lhs.(types.String))
+					return types.Bool(v != "" && compareVersions(v, string(rhs.(types.String))) >= 0)
+				}),
+			),
+		),
+	}
+}
+
+// newCelEnv creates the CEL environment with the functions and the variables of the context, dyn declares additional variables of any type
+func newCelEnv(ctx RuleContext, opts RuleOptions, dyn ...string) (*cel.Env, error) {
+	options := celFunctions(ctx, opts)
+	for name, value := range ctx {
+		options = append(options, cel.Variable(name, celType(value)))
+	}
+	for _, name := range dyn {
+		if _, ok := ctx[name]; !ok {
+			options = append(options, cel.Variable(name, cel.DynType))
+		}
+	}
+
+	env, err := cel.NewEnv(options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cel environment: %w", err)
+	}
+	return env, nil
+}
+
+// celType returns the CEL type of a context value, values of other types are declared as dyn
+func celType(value interface{}) *cel.Type {
+	switch value.(type) {
+	case int, int32, int64:
+		return cel.IntType
+	case float32, float64:
+		return cel.DoubleType
+	case bool:
+		return cel.BoolType
+	case string:
+		return cel.StringType
+	case []string:
+		return cel.ListType(cel.StringType)
+	case map[string]string:
+		return cel.MapType(cel.StringType, cel.StringType)
+	default:
+		return cel.DynType
+	}
+}
+
+// EvalBool evaluates a boolean CEL expression with the context, an empty expression is false
+func EvalBool(expression string, ctx RuleContext) (bool, error) {
+	if expression == "" {
+		return false, nil
+	}
+
+	env, err := newCelEnv(ctx, RuleOptions{})
+	if err != nil {
+		return false, err
+	}
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return false, fmt.Errorf("failed to compile expression: %w", issues.Err())
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return false, fmt.Errorf("failed to construct program: %w", err)
+	}
+
+	out, _, err := prg.Eval(map[string]interface{}(ctx))
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate expression: %w", err)
+	}
+	if out.Type() != types.BoolType {
+		return false, fmt.Errorf("expression did not evaluate to bool, got %s", out.Type().TypeName())
+	}
+	return out.Value() == true, nil
+}
+
+// cmdVersion returns the first version number printed by `<name> --version`, empty if the command fails or prints none
+func cmdVersion(name string) string {
+	cmdVersionsMu.Lock()
+	defer cmdVersionsMu.Unlock()
+
+	if v, ok := cmdVersions[name]; ok {
+		return v
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cmdVersionTimeout)
+	defer cancel()
+
+	version := ""
+	if out, err := exec.CommandContext(ctx, name, "--version").Output(); err == nil {
+		version = versionRegex.FindString(string(out))
+	}
+	cmdVersions[name] = version
+	return version
+}
+
+// compareVersions compares dotted version numbers such as v0.10.2, missing components are zero
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := range max(len(pa), len(pb)) {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if c := cmp.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// versionParts returns the numeric components of the first version number in the string
+func versionParts(v string) []int {
+	var parts []int
+	for _, s := range strings.Split(versionPartsRegex.FindString(v), ".") {
+		n, _ := strconv.Atoi(s)
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// osRelease returns the ID and VERSION_ID of /etc/os-release, empty on systems without the file
+func osRelease() (id string, version string) {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found {
+			continue
+		}
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "ID":
+			id = value
+		case "VERSION_ID":
+			version = value
+		}
+	}
+	return id, version
+}
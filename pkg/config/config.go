@@ -1,19 +1,23 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"os/user"
+	"runtime"
 	"slices"
 
-	"github.com/cidverse/go-rules/pkg/expr"
 	"log/slog"
 )
 
 type DotfilesConfig struct {
-	Themes      []ThemeConfig  `yaml:"themes"`             // Themes defines theme-specific configurations
-	Commands    []ThemeCommand `yaml:"activationCommands"` // Commands to run when a theme is activated
-	Directories []Dir          `yaml:"directories"`        // Directories to copy
-	Includes    []string       `yaml:"includes"`           // Include optional configuration files
+	Themes      []ThemeConfig       `yaml:"themes"`             // Themes defines theme-specific configurations
+	Commands    []ThemeCommand      `yaml:"activationCommands"` // Commands to run when a theme is activated
+	Directories []Dir               `yaml:"directories"`        // Directories to copy
+	Includes    []Include           `yaml:"includes"`           // Include additional configuration files
+	Profiles    []Profile           `yaml:"profiles"`           // Profiles select the directories, theme and context for a kind of machine
+	Variables   map[string]Variable `yaml:"variables"`          // Values for rules, templates and target paths
+	Hosts       map[string]Host     `yaml:"hosts"`              // Per-host overrides, by hostname
 }
 
 func (c *DotfilesConfig) GetTheme(name string) *ThemeConfig {
@@ -25,6 +29,16 @@ func (c *DotfilesConfig) GetTheme(name string) *ThemeConfig {
 	return nil
 }
 
+// GetProfile returns the profile with the name, or nil if it is not defined
+func (c *DotfilesConfig) GetProfile(name string) *Profile {
+	for _, p := range c.Profiles {
+		if p.Name == name {
+			return &p
+		}
+	}
+	return nil
+}
+
 type ThemeConfig struct {
 	Name         string            `yaml:"name"`
 	ColorScheme  string            `yaml:"colorScheme"`
@@ -36,6 +50,21 @@ type ThemeConfig struct {
 	CursorTheme  string            `yaml:"cursorTheme"`
 	Properties   map[string]string `yaml:"properties"`
 	Commands     []ThemeCommand    `yaml:"commands"`
+	Merge        string            `yaml:"merge" json:"-"` // How an included theme overrides a theme with the same name (patch, replace, remove)
+}
+
+type Profile struct {
+	Name        string                 `yaml:"name"`
+	Directories []string               `yaml:"directories"` // Names, paths or tags of the directories to install, all directories if empty
+	Theme       string                 `yaml:"theme"`       // Theme used if no theme is selected
+	Context     map[string]interface{} `yaml:"context"`     // Additional values for rule evaluation and templates, overridden by --context
+	Variables   map[string]Variable    `yaml:"variables"`   // Overrides the variables of the configuration
+	Merge       string                 `yaml:"merge"`       // How an included profile overrides a profile with the same name (patch, replace, remove)
+}
+
+// Selects reports whether the profile installs the directory
+func (p *Profile) Selects(d Dir) bool {
+	return len(p.Directories) == 0 || slices.ContainsFunc(p.Directories, d.Matches)
 }
 
 type ThemeCommand struct {
@@ -45,42 +74,81 @@ type ThemeCommand struct {
 }
 
 type Dir struct {
-	Path          string        `yaml:"path"`
-	Paths         []string      `yaml:"paths"` // Can be used to specify multiple possible paths, first one that exists will be used.
-	Target        string        `yaml:"target"`
-	Mode          string        `yaml:"mode"`          // Override global mode for this directory (copy, symlink)
-	Rules         []Rules       `yaml:"rules"`         // At least one condition must match for the rule to apply
-	TemplateFiles []string      `yaml:"templateFiles"` // Files that need to be processed as templates, allowing the use of theme properties
-	ThemeFiles    []ThemeFile   `yaml:"themeFiles"`    // Theme-specific files to copy
-	LinkFiles     []LinkFile    `yaml:"linkFiles"`     // Individual file symlinks with fallback paths
+	Name          string      `yaml:"name"` // Identifies the directory for includes, defaults to the path
+	Path          string      `yaml:"path"`
+	Tags          []string    `yaml:"tags"`  // Tags for selecting the directory in profiles
+	Paths         []string    `yaml:"paths"` // Can be used to specify multiple possible paths, first one that exists will be used.
+	Target        string      `yaml:"target"`
+	Mode          string      `yaml:"mode"`                      // Override global mode for this directory (copy, symlink)
+	Conflict      string      `yaml:"conflict"`                  // Override global conflict policy for existing unmanaged targets (skip, overwrite, backup, fail, prompt)
+	Rules         []Rules     `yaml:"rules" merge:"replace"`     // At least one rule must match to install the directory, evaluated once before the files are collected
+	FileRules     []Rules     `yaml:"fileRules" merge:"replace"` // At least one rule must match to install a file, evaluated for each file with the file variable
+	TemplateFiles []string    `yaml:"templateFiles"`             // Files that need to be processed as templates, allowing the use of theme properties
+	ThemeFiles    []ThemeFile `yaml:"themeFiles"`                // Theme-specific files to copy
+	LinkFiles     []LinkFile  `yaml:"linkFiles"`                 // Individual file symlinks with fallback paths
+	Priority      int         `yaml:"priority"`                  // Wins over directories with a lower priority that provide the same target (default 0)
+	Merge         string      `yaml:"merge"`                     // How an included directory overrides a directory with the same id (patch, replace, remove)
+	Pos           Position    `yaml:"-" json:"-"`                // Location of the entry in the configuration file
 }
 
+// Conflict policies for targets that exist but are not managed
+const (
+	ConflictSkip      = "skip"      // keep the existing target
+	ConflictOverwrite = "overwrite" // replace the existing target
+	ConflictBackup    = "backup"    // move the existing target aside, then replace it
+	ConflictFail      = "fail"      // abort the installation before any change is made
+	ConflictPrompt    = "prompt"    // ask for each conflicting target
+)
+
+// ConflictPolicies lists all valid conflict policies
+var ConflictPolicies = []string{ConflictSkip, ConflictOverwrite, ConflictBackup, ConflictFail, ConflictPrompt}
+
+// Modes lists all valid install modes, template renders every file of a directory
+var Modes = []string{"copy", "symlink", "template"}
+
 type Rules struct {
 	Rule    string   `yaml:"rule"`
-	Exclude []string `yaml:"exclude"` // Exclude paths or files
+	Exclude []string `yaml:"exclude"` // Patterns relative to the directory source, supports ** globs, ! negation and regex: prefixes
 }
 
 type ThemeFile struct {
 	Target  string            `yaml:"target"`
 	Sources map[string]string `yaml:"sources"`
+	Rules   []Rules           `yaml:"rules"` // At least one rule must match to install the file, evaluated with the selected source
 }
 
 type LinkFile struct {
-	Paths  []string `yaml:"paths"`  // Ordered list of source candidates (absolute or ~/ paths), first that exists wins
-	Target string   `yaml:"target"` // Destination path (supports ~/ and env vars)
-	Mode   string   `yaml:"mode"`   // Override global mode for this file (copy, symlink)
+	Paths    []string `yaml:"paths"`    // Ordered list of source candidates (absolute or ~/ paths), first that exists wins
+	Target   string   `yaml:"target"`   // Destination path (supports ~/ and env vars)
+	Mode     string   `yaml:"mode"`     // Override global mode for this file (copy, symlink)
+	Conflict string   `yaml:"conflict"` // Override conflict policy for this file (skip, overwrite, backup, fail, prompt)
+	Rules    []Rules  `yaml:"rules"`    // At least one rule must match to install the file, evaluated with the first existing path
 }
 
-func EvaluateRules(conditions []Rules, sourceFile string) bool {
+func EvaluateRules(conditions []Rules, sourceFile string) (bool, error) {
 	return EvaluateRulesWithContext(BuildRuleContext(), conditions, sourceFile)
 }
 
+// RuleError is returned if a rule expression can not be evaluated
+type RuleError struct {
+	Rule string
+	Err  error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("failed to evaluate rule %q, check your configuration file syntax: %v", e.Rule, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
 // RuleContext holds the shared context for rule evaluation (user, theme, wsl).
 type RuleContext map[string]interface{}
 
 // BuildRuleContext creates a shared rule context that can be reused across files.
 // Only the "file" field changes per-file; everything else is constant.
-// Available variables: user, home, hostname, theme, wsl
+// Available variables: user, home, hostname, theme, wsl, os, arch, distro, distroVersion, desktop
 func BuildRuleContext() RuleContext {
 	// user info
 	var username, homeDir string
@@ -97,42 +165,36 @@ func BuildRuleContext() RuleContext {
 	// hostname
 	hostname, _ := os.Hostname()
 
+	// distribution
+	distro, distroVersion := osRelease()
+
 	// context
 	ctx := map[string]interface{}{
-		"user":     username,
-		"home":     homeDir,
-		"hostname": hostname,
-		"theme":    os.Getenv("DOTFILE_THEME"),
-		"wsl":      os.Getenv("WSL_DISTRO_NAME") != "",
+		"user":          username,
+		"home":          homeDir,
+		"hostname":      hostname,
+		"theme":         os.Getenv("DOTFILE_THEME"),
+		"wsl":           os.Getenv("WSL_DISTRO_NAME") != "",
+		"os":            runtime.GOOS,
+		"arch":          runtime.GOARCH,
+		"distro":        distro,
+		"distroVersion": distroVersion,
+		"desktop":       os.Getenv("XDG_CURRENT_DESKTOP"),
+		"env":           os.Environ(),
 	}
 
 	return RuleContext(ctx)
 }
 
-func EvaluateRulesWithContext(ctx RuleContext, conditions []Rules, sourceFile string) bool {
+// EvaluateRulesWithContext evaluates the conditions for a single file, use a RuleEngine to evaluate many files
+func EvaluateRulesWithContext(ctx RuleContext, conditions []Rules, sourceFile string) (bool, error) {
 	if len(conditions) == 0 {
-		return true
+		return true, nil
 	}
 
-	ctx["file"] = sourceFile
-
-	// evaluate
-	for _, c := range conditions {
-		// excludes
-		if slices.Contains(c.Exclude, sourceFile) {
-			return false
-		}
-
-		// match expression
-		match, cErr := expr.EvaluateRule(c.Rule, ctx)
-		if cErr != nil {
-			slog.Error("failed to evaluate condition, check your configuration file syntax", "rule", c.Rule, "err", cErr)
-			os.Exit(1)
-		}
-		if match {
-			return true
-		}
+	engine, err := NewRuleEngine(ctx)
+	if err != nil {
+		return false, err
 	}
-
-	return false
+	return engine.Evaluate(conditions, sourceFile)
 }
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+)
+
+// MaxGenerations is the number of install generations that are kept
+const MaxGenerations = 20
+
+// Generation is a snapshot of the managed files produced by an install or rollback
+type Generation struct {
+	ID           int           `json:"id"`
+	CreatedAt    time.Time     `json:"created_at"`
+	Source       string        `json:"source"`
+	SourceCommit string        `json:"source_commit,omitempty"` // git commit of the source, if it is a git repository
+	ConfigHash   string        `json:"config_hash,omitempty"`   // sha256 of dotfiles.yaml
+	Mode         string        `json:"mode,omitempty"`
+	Theme        string        `json:"theme"`
+	Profile      string        `json:"profile,omitempty"`
+	ActiveTheme  *ThemeConfig  `json:"active_theme"`
+	ManagedFiles []ManagedFile `json:"managed_files"`
+	Description  string        `json:"description,omitempty"`
+}
+
+// GenerationDir returns the directory containing the generations, located next to the state file
+func (st *Store) GenerationDir() string {
+	return filepath.Join(filepath.Dir(st.StateFile), "generations")
+}
+
+// snapshotFile returns the content-addressed location of a file snapshot
+func (st *Store) snapshotFile(hash string) string {
+	return filepath.Join(st.GenerationDir(), "objects", hash)
+}
+
+// SaveSnapshot stores the content under its sha256 hash, existing snapshots are reused
+func (st *Store) SaveSnapshot(content []byte) (string, error) {
+	hash := util.HashBytes(content)
+	file := st.snapshotFile(hash)
+	if _, err := st.FS.Stat(file); err == nil {
+		return hash, nil
+	}
+
+	if err := util.CreateParentDirectory(st.FS, file); err != nil {
+		return "", err
+	}
+	return hash, st.FS.WriteFile(file, content, 0600)
+}
+
+// LoadSnapshot returns the content stored under the sha256 hash
+func (st *Store) LoadSnapshot(hash string) ([]byte, error) {
+	content, err := st.FS.ReadFile(st.snapshotFile(hash))
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s not found: %w", hash, err)
+	}
+	return content, nil
+}
+
+// ListGenerations returns all generations, ordered by id
+func (st *Store) ListGenerations() ([]Generation, error) {
+	entries, err := st.FS.ReadDir(st.GenerationDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var generations []Generation
+	for _, e := range entries {
+		id, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".json"))
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") || err != nil {
+			continue
+		}
+
+		g, err := st.LoadGeneration(id)
+		if err != nil {
+			return nil, err
+		}
+		generations = append(generations, *g)
+	}
+	slices.SortFunc(generations, func(a, b Generation) int {
+		return a.ID - b.ID
+	})
+
+	return generations, nil
+}
+
+// LoadGeneration loads the generation with the given id
+func (st *Store) LoadGeneration(id int) (*Generation, error) {
+	data, err := st.FS.ReadFile(filepath.Join(st.GenerationDir(), fmt.Sprintf("%d.json", id)))
+	if err != nil {
+		return nil, fmt.Errorf("generation %d not found: %w", id, err)
+	}
+
+	var g Generation
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, fmt.Errorf("failed to parse generation %d: %w", id, err)
+	}
+	return &g, nil
+}
+
+// SaveGeneration assigns the next id to the generation, persists it and prunes old generations
+func (st *Store) SaveGeneration(g *Generation) error {
+	generations, err := st.ListGenerations()
+	if err != nil {
+		return err
+	}
+	g.ID = 1
+	if len(generations) > 0 {
+		g.ID = generations[len(generations)-1].ID + 1
+	}
+
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(st.GenerationDir(), fmt.Sprintf("%d.json", g.ID))
+	if err := util.CreateParentDirectory(st.FS, file); err != nil {
+		return err
+	}
+	if err := st.FS.WriteFile(file, data, 0644); err != nil {
+		return err
+	}
+
+	return st.pruneGenerations(append(generations, *g))
+}
+
+// pruneGenerations removes the oldest generations and snapshots that are no longer referenced
+func (st *Store) pruneGenerations(generations []Generation) error {
+	if len(generations) <= MaxGenerations {
+		return nil
+	}
+
+	removed := generations[:len(generations)-MaxGenerations]
+	kept := generations[len(generations)-MaxGenerations:]
+	for _, g := range removed {
+		if err := st.FS.Remove(filepath.Join(st.GenerationDir(), fmt.Sprintf("%d.json", g.ID))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for _, g := range kept {
+		for _, f := range g.ManagedFiles {
+			referenced[f.Hash] = true
+		}
+	}
+	objects, err := st.FS.ReadDir(filepath.Join(st.GenerationDir(), "objects"))
+	if err != nil {
+		return nil
+	}
+	for _, o := range objects {
+		if !referenced[o.Name()] {
+			_ = st.FS.Remove(st.snapshotFile(o.Name()))
+		}
+	}
+
+	return nil
+}
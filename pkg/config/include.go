@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+	"gopkg.in/yaml.v3"
+)
+
+// Include references additional configuration files, either the path or an object with path and required
+type Include struct {
+	Path     string `yaml:"path"`     // File or glob pattern (supports ~ and env vars), relative to the including file
+	Required bool   `yaml:"required"` // Fail if no file exists instead of skipping the include
+}
+
+// UnmarshalYAML supports the plain path used by configuration files before includes could be required
+func (i *Include) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*i = Include{}
+		return node.Decode(&i.Path)
+	}
+
+	type plain Include
+	return node.Decode((*plain)(i))
+}
+
+// resolveInclude returns the files matching the include, sorted by name for glob patterns
+func resolveInclude(baseDir string, include Include) ([]string, error) {
+	path := util.ExpandPath(include.Path, "")
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+
+	// literal path
+	if !strings.ContainsAny(path, "*?[") {
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) && !include.Required {
+				slog.Debug("include does not exist, skipping", "include", include.Path)
+				return nil, nil
+			}
+			return nil, fmt.Errorf("required include %s does not exist", include.Path)
+		}
+		return []string{path}, nil
+	}
+
+	// glob pattern
+	matches, err := filepath.Glob(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern %s: %w", include.Path, err)
+	}
+	if len(matches) == 0 && include.Required {
+		return nil, fmt.Errorf("required include %s matches no files", include.Path)
+	}
+	return matches, nil
+}
+
+// includeCycle returns the include chain leading to the file if the file is already being loaded, empty otherwise
+func includeCycle(chain []string, file string) string {
+	if !slices.Contains(chain, file) {
+		return ""
+	}
+	return strings.Join(append(slices.Clone(chain), file), " -> ")
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Unknown key handling for LoadOptions.UnknownKeys
+const (
+	UnknownKeysError = "error" // unknown keys fail loading the configuration
+	UnknownKeysWarn  = "warn"  // unknown keys are logged and ignored
+)
+
+// UnknownKeyError is returned for keys that do not exist in the configuration format, e.g. typos
+type UnknownKeyError struct {
+	Position
+	Key        string
+	Suggestion string // closest valid key, empty if none is similar
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Position, e.Message())
+}
+
+// Message describes the unknown key without its position
+func (e *UnknownKeyError) Message() string {
+	if e.Suggestion != "" {
+		return fmt.Sprintf("unknown key %q, did you mean %q?", e.Key, e.Suggestion)
+	}
+	return fmt.Sprintf("unknown key %q", e.Key)
+}
+
+// unknownKeys returns all mapping keys that do not correspond to a field of the target type
+func unknownKeys(file string, node *yaml.Node, t reflect.Type) []*UnknownKeyError {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var result []*UnknownKeyError
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				continue
+			}
+			ft, ok := fields[key.Value]
+			if !ok {
+				result = append(result, &UnknownKeyError{
+					Position:   Position{File: file, Line: key.Line, Column: key.Column},
+					Key:        key.Value,
+					Suggestion: closestKey(key.Value, fields),
+				})
+				continue
+			}
+			result = append(result, unknownKeys(file, value, ft)...)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return nil
+		}
+		for _, item := range node.Content {
+			result = append(result, unknownKeys(file, item, t.Elem())...)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 1; i < len(node.Content); i += 2 {
+			result = append(result, unknownKeys(file, node.Content[i], t.Elem())...)
+		}
+	}
+
+	return result
+}
+
+// yamlFields returns the yaml keys of a struct and the type of the corresponding field
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// closestKey suggests the valid key with the smallest edit distance, ignoring case, dashes and underscores
+func closestKey(key string, fields map[string]reflect.Type) string {
+	normalize := func(s string) string {
+		return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(s))
+	}
+
+	best, bestDistance := "", -1
+	for _, candidate := range slices.Sorted(maps.Keys(fields)) {
+		d := levenshtein(normalize(key), normalize(candidate))
+		if bestDistance == -1 || d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+
+	// only suggest keys that are reasonably similar
+	if bestDistance == -1 || bestDistance > max(2, len(key)/3) {
+		return ""
+	}
+	return best
+}
+
+// levenshtein returns the number of single character edits required to change a into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
@@ -1,14 +1,34 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 
 	"gopkg.in/yaml.v3"
 )
 
+// LoadOptions configures how the configuration files are decoded
+type LoadOptions struct {
+	Require     bool   // fail if the file does not exist
+	UnknownKeys string // error (default) or warn
+}
+
 func Load(file string, require bool) (*DotfilesConfig, error) {
+	return LoadWithOptions(file, LoadOptions{Require: require})
+}
+
+// LoadWithOptions loads the configuration file and merges all includes, unknown keys are rejected unless downgraded to warnings
+func LoadWithOptions(file string, opts LoadOptions) (*DotfilesConfig, error) {
+	return load(file, opts, nil)
+}
+
+// load loads the configuration file, chain contains the files that include it to detect cycles
+func load(file string, opts LoadOptions, chain []string) (*DotfilesConfig, error) {
 	cfg := DotfilesConfig{}
 
 	absFile, err := filepath.Abs(file)
@@ -16,10 +36,14 @@ func Load(file string, require bool) (*DotfilesConfig, error) {
 		return nil, err
 	}
 	baseDir := filepath.Dir(absFile)
+	if cycle := includeCycle(chain, absFile); cycle != "" {
+		return nil, fmt.Errorf("include cycle: %s", cycle)
+	}
+	chain = append(slices.Clone(chain), absFile)
 
 	// if file does not exist, return empty state
 	if _, err := os.Stat(file); os.IsNotExist(err) {
-		if !require {
+		if !opts.Require {
 			return &cfg, nil
 		}
 		return nil, err
@@ -32,37 +56,62 @@ func Load(file string, require bool) (*DotfilesConfig, error) {
 	}
 
 	// unmarshal
-	yamlErr := yaml.Unmarshal(fileContent, &cfg)
-	if yamlErr != nil {
-		return nil, yamlErr
+	var node yaml.Node
+	if err := yaml.Unmarshal(fileContent, &node); err != nil {
+		return nil, err
 	}
-
-	if len(cfg.Includes) > 0 {
-		for _, include := range cfg.Includes {
-			includePath := include
-			if !filepath.IsAbs(include) {
-				includePath = filepath.Join(baseDir, include)
+	if root := documentRoot(&node); root != nil {
+		var errs []error
+		for _, e := range unknownKeys(absFile, root, reflect.TypeOf(DotfilesConfig{})) {
+			if opts.UnknownKeys == UnknownKeysWarn {
+				slog.Warn("ignoring unknown key in configuration", "file", e.File, "line", e.Line, "key", e.Key, "suggestion", e.Suggestion)
+				continue
 			}
+			errs = append(errs, e)
+		}
+		if len(errs) > 0 {
+			return nil, errors.Join(errs...)
+		}
+	}
+	if err := node.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	setPositions(&cfg, &node, absFile)
+
+	for _, include := range cfg.Includes {
+		includePaths, err := resolveInclude(baseDir, include)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, includePath := range includePaths {
 			slog.Debug("including config file", "file", includePath)
 
-			includeCfg, err := Load(includePath, false)
+			includeCfg, err := load(includePath, LoadOptions{Require: true, UnknownKeys: opts.UnknownKeys}, chain)
 			if err != nil {
 				return nil, err
 			}
 
-			cfg = *mergeConfigs(cfg, *includeCfg)
+			merged, err := mergeConfigs(cfg, *includeCfg)
+			if err != nil {
+				return nil, fmt.Errorf("failed to merge %s: %w", includePath, err)
+			}
+			cfg = *merged
 		}
 	}
 
 	return &cfg, nil
 }
 
-func mergeConfigs(a DotfilesConfig, b DotfilesConfig) *DotfilesConfig {
-	merged := a
-
-	merged.Themes = append(merged.Themes, b.Themes...)
-	merged.Commands = append(merged.Commands, b.Commands...)
-	merged.Directories = append(merged.Directories, b.Directories...)
-
-	return &merged
+// setPositions records where each directory entry is defined, used to report problems
+func setPositions(cfg *DotfilesConfig, node *yaml.Node, file string) {
+	_, dirs := mappingValue(documentRoot(node), "directories")
+	if dirs == nil || dirs.Kind != yaml.SequenceNode {
+		return
+	}
+	for i, item := range dirs.Content {
+		if i < len(cfg.Directories) {
+			cfg.Directories[i].Pos = Position{File: file, Line: item.Line, Column: item.Column}
+		}
+	}
 }
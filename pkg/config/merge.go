@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// Merge strategies for theme and directory entries of included files that match an existing entry
+const (
+	MergePatch   = "patch"   // set fields override, lists are appended and maps are merged
+	MergeReplace = "replace" // the entry replaces the existing entry
+	MergeRemove  = "remove"  // the existing entry is removed
+)
+
+// MergeStrategies lists all valid merge strategies
+var MergeStrategies = []string{MergePatch, MergeReplace, MergeRemove}
+
+// ID identifies the directory for includes, the name if set and otherwise the path
+func (d Dir) ID() string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return d.Path
+}
+
+// Matches reports whether the selector is the name, path or a tag of the directory
+func (d Dir) Matches(selector string) bool {
+	return d.Name == selector || d.Path == selector || slices.Contains(d.Tags, selector)
+}
+
+// mergeConfigs merges an included config into the config.
+// Themes and profiles with the same name are patched, directories with the same name are patched and
+// the merge field selects how an entry overrides an existing theme or directory (patch, replace, remove).
+func mergeConfigs(a DotfilesConfig, b DotfilesConfig) (*DotfilesConfig, error) {
+	merged := a
+	merged.Themes = slices.Clone(a.Themes)
+	merged.Profiles = slices.Clone(a.Profiles)
+	merged.Directories = slices.Clone(a.Directories)
+	merged.Commands = append(slices.Clone(a.Commands), b.Commands...)
+
+	// variables and hosts, the included values win
+	if len(b.Variables) > 0 {
+		merged.Variables = maps.Clone(a.Variables)
+		if merged.Variables == nil {
+			merged.Variables = make(map[string]Variable)
+		}
+		maps.Copy(merged.Variables, b.Variables)
+	}
+	if len(b.Hosts) > 0 {
+		merged.Hosts = maps.Clone(a.Hosts)
+		if merged.Hosts == nil {
+			merged.Hosts = make(map[string]Host)
+		}
+		for name, host := range b.Hosts {
+			existing := merged.Hosts[name]
+			patch(reflect.ValueOf(&existing).Elem(), reflect.ValueOf(host))
+			merged.Hosts[name] = existing
+		}
+	}
+
+	// themes
+	for _, t := range b.Themes {
+		i := slices.IndexFunc(merged.Themes, func(existing ThemeConfig) bool { return existing.Name == t.Name })
+		themes, err := mergeEntry(merged.Themes, i, t, t.Merge, true, "theme "+t.Name)
+		if err != nil {
+			return nil, err
+		}
+		merged.Themes = themes
+	}
+
+	// profiles
+	for _, p := range b.Profiles {
+		i := slices.IndexFunc(merged.Profiles, func(existing Profile) bool { return existing.Name == p.Name })
+		profiles, err := mergeEntry(merged.Profiles, i, p, p.Merge, true, "profile "+p.Name)
+		if err != nil {
+			return nil, err
+		}
+		merged.Profiles = profiles
+	}
+
+	// directories, unnamed directories are only matched by path if a merge strategy is set
+	for _, d := range b.Directories {
+		i := slices.IndexFunc(merged.Directories, func(existing Dir) bool { return existing.ID() == d.ID() })
+		dirs, err := mergeEntry(merged.Directories, i, d, d.Merge, d.Name != "", "directory "+d.ID())
+		if err != nil {
+			return nil, err
+		}
+		merged.Directories = dirs
+	}
+
+	return &merged, nil
+}
+
+// mergeEntry applies the merge strategy of the entry to the existing entry at index i (-1 if there is none)
+func mergeEntry[T any](entries []T, i int, entry T, strategy string, patchByDefault bool, name string) ([]T, error) {
+	if strategy == "" {
+		if i < 0 || !patchByDefault {
+			return append(entries, entry), nil
+		}
+		strategy = MergePatch
+	}
+	if !slices.Contains(MergeStrategies, strategy) {
+		return nil, fmt.Errorf("invalid merge strategy %q for %s (valid values: patch, replace, remove)", strategy, name)
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("can not %s %s, it is not defined by a previous config file", strategy, name)
+	}
+
+	switch strategy {
+	case MergeRemove:
+		return slices.Delete(entries, i, i+1), nil
+	case MergeReplace:
+		entries[i] = entry
+	case MergePatch:
+		patch(reflect.ValueOf(&entries[i]).Elem(), reflect.ValueOf(entry))
+	}
+	reflect.ValueOf(&entries[i]).Elem().FieldByName("Merge").SetString("")
+
+	return entries, nil
+}
+
+// patch overrides the fields of dst that are set in src (except fields that are not part of the config file), lists are appended unless tagged with merge:"replace" and maps are merged
+func patch(dst reflect.Value, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		if !field.IsExported() || field.Tag.Get("yaml") == "-" || src.Field(i).IsZero() {
+			continue
+		}
+
+		d, s := dst.Field(i), src.Field(i)
+		switch {
+		case field.Type.Kind() == reflect.Slice && field.Tag.Get("merge") != "replace":
+			d.Set(reflect.AppendSlice(reflect.MakeSlice(field.Type, 0, d.Len()+s.Len()), d))
+			d.Set(reflect.AppendSlice(d, s))
+		case field.Type.Kind() == reflect.Map && !d.IsNil():
+			m := reflect.MakeMapWithSize(field.Type, d.Len()+s.Len())
+			for _, v := range []reflect.Value{d, s} {
+				iter := v.MapRange()
+				for iter.Next() {
+					m.SetMapIndex(iter.Key(), iter.Value())
+				}
+			}
+			d.Set(m)
+		default:
+			d.Set(s)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/interpreter"
+)
+
+// RuleEngine compiles each distinct rule once and evaluates the cached programs.
+// The variables are declared from the rule context, only the file changes between evaluations.
+type RuleEngine struct {
+	env        *cel.Env
+	activation interpreter.Activation
+	mu         sync.Mutex
+	programs   map[string]cel.Program
+}
+
+// NewRuleEngine creates a rule engine for the rule context, which must not change afterwards
+func NewRuleEngine(ctx RuleContext) (*RuleEngine, error) {
+	return NewRuleEngineWithOptions(ctx, RuleOptions{})
+}
+
+// NewRuleEngineWithOptions creates a rule engine whose functions access the system as configured by the options
+func NewRuleEngineWithOptions(ctx RuleContext, opts RuleOptions) (*RuleEngine, error) {
+	declared := maps.Clone(ctx)
+	if declared == nil {
+		declared = RuleContext{}
+	}
+	if _, ok := declared["file"]; !ok {
+		declared["file"] = ""
+	}
+
+	env, err := newCelEnv(declared, opts)
+	if err != nil {
+		return nil, err
+	}
+	activation, err := interpreter.NewActivation(map[string]interface{}(declared))
+	if err != nil {
+		return nil, err
+	}
+
+	return &RuleEngine{env: env, activation: activation, programs: make(map[string]cel.Program)}, nil
+}
+
+// Compile returns the program of the rule, it is only compiled on first use
+func (e *RuleEngine) Compile(rule string) (cel.Program, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if prg, ok := e.programs[rule]; ok {
+		return prg, nil
+	}
+
+	ast, issues := e.env.Compile(rule)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("failed to compile expression: %w", issues.Err())
+	}
+	if t := ast.OutputType(); !t.IsExactType(cel.BoolType) && !t.IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("expression must evaluate to bool, got %s", t)
+	}
+	prg, err := e.env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct program: %w", err)
+	}
+	e.programs[rule] = prg
+
+	return prg, nil
+}
+
+// CompileDirs compiles the rules of the directories, errors contain the position of the directory
+func (e *RuleEngine) CompileDirs(dirs []Dir) error {
+	var errs []error
+	for _, dir := range dirs {
+		rules := slices.Concat(dir.Rules, dir.FileRules)
+		for _, tf := range dir.ThemeFiles {
+			rules = append(rules, tf.Rules...)
+		}
+		for _, lf := range dir.LinkFiles {
+			rules = append(rules, lf.Rules...)
+		}
+
+		for _, r := range rules {
+			if _, err := e.Compile(r.Rule); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", dir.Pos, &RuleError{Rule: r.Rule, Err: err}))
+			}
+		}
+		if _, err := NewExcludes(rules, ""); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", dir.Pos, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Eval evaluates the rule for the source file
+func (e *RuleEngine) Eval(rule string, sourceFile string) (bool, error) {
+	if rule == "" {
+		return false, nil
+	}
+
+	prg, err := e.Compile(rule)
+	if err != nil {
+		return false, err
+	}
+	file, err := interpreter.NewActivation(map[string]interface{}{"file": sourceFile})
+	if err != nil {
+		return false, err
+	}
+
+	out, _, err := prg.Eval(interpreter.NewHierarchicalActivation(e.activation, file))
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate expression: %w", err)
+	}
+	match, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression did not evaluate to bool, got %s", out.Type().TypeName())
+	}
+	return match, nil
+}
+
+// Evaluate checks the conditions for the source file, the file matches if it is not excluded and at least one rule matches.
+// Without the directory source, excludes are matched against the absolute path.
+func (e *RuleEngine) Evaluate(conditions []Rules, sourceFile string) (bool, error) {
+	excludes, err := NewExcludes(conditions, "")
+	if err != nil {
+		return false, err
+	}
+	if excludes.Match(sourceFile) {
+		return false, nil
+	}
+	return e.Match(conditions, sourceFile)
+}
+
+// Match reports whether at least one rule matches, ignoring the excludes
+func (e *RuleEngine) Match(conditions []Rules, sourceFile string) (bool, error) {
+	if len(conditions) == 0 {
+		return true, nil
+	}
+
+	for _, c := range conditions {
+		match, err := e.Eval(c.Rule, sourceFile)
+		if err != nil {
+			return false, &RuleError{Rule: c.Rule, Err: err}
+		}
+		if match {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Excludes matches source files against the excludes of rules, patterns are relative to the directory source
+type Excludes struct {
+	dir      string
+	patterns *util.Patterns
+	absolute *util.Patterns // absolute paths outside the directory source, e.g. of theme sources
+}
+
+// NewExcludes parses the excludes of the conditions, see util.Patterns for the syntax.
+// Absolute paths inside the directory source are anchored to it, absolute paths outside of it are compared with the absolute source file.
+func NewExcludes(conditions []Rules, dirSource string) (*Excludes, error) {
+	var lines, absoluteLines []string
+	for _, c := range conditions {
+		for _, exclude := range c.Exclude {
+			negate := strings.HasPrefix(exclude, "!")
+			p := strings.TrimPrefix(exclude, "!")
+			outside := false
+			if dirSource != "" && filepath.IsAbs(p) {
+				if rel, err := filepath.Rel(dirSource, p); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+					p = "/" + filepath.ToSlash(rel)
+				} else {
+					outside = true
+				}
+			}
+			if negate {
+				p = "!" + p
+			}
+			if outside {
+				absoluteLines = append(absoluteLines, p)
+			} else {
+				lines = append(lines, p)
+			}
+		}
+	}
+
+	patterns, err := util.ParsePatterns(lines)
+	if err != nil {
+		return nil, err
+	}
+	absolute, err := util.ParsePatterns(absoluteLines)
+	if err != nil {
+		return nil, err
+	}
+	return &Excludes{dir: dirSource, patterns: patterns, absolute: absolute}, nil
+}
+
+// Match reports whether the source file is excluded, files outside the directory source are only matched by absolute excludes
+func (e *Excludes) Match(sourceFile string) bool {
+	absolute := strings.TrimPrefix(filepath.ToSlash(sourceFile), "/")
+	if e.dir == "" {
+		return e.patterns.Excludes(absolute)
+	}
+	if e.absolute.Excludes(absolute) {
+		return true
+	}
+	rel, err := filepath.Rel(e.dir, sourceFile)
+	if err != nil {
+		return false
+	}
+	return e.patterns.Excludes(filepath.ToSlash(rel))
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+var yamlUnmarshaler = reflect.TypeFor[yaml.Unmarshaler]()
+
+// schemaShorthands lists the scalar types accepted instead of the object by types with a custom unmarshaler, string if not listed
+var schemaShorthands = map[string]any{
+	"Variable": []string{"string", "number", "boolean"},
+}
+
+// schemaEnums lists the allowed values of keys with a fixed set of values
+var schemaEnums = map[string][]string{
+	"mode":     Modes,
+	"conflict": ConflictPolicies,
+	"merge":    MergeStrategies,
+}
+
+// JSONSchema generates the JSON Schema of dotfiles.yaml from the configuration types, so it never gets out of sync
+func JSONSchema() map[string]any {
+	defs := make(map[string]any)
+	schema := structSchema(reflect.TypeOf(DotfilesConfig{}), defs)
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = "https://github.com/PhilippHeuer/dotfiles-cli/dotfiles.schema.json"
+	schema["title"] = "dotfiles.yaml"
+	schema["$defs"] = defs
+
+	return schema
+}
+
+func typeSchema(t reflect.Type, defs map[string]any) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem(), defs)}
+	case reflect.Struct:
+		if _, ok := defs[t.Name()]; !ok {
+			defs[t.Name()] = nil // placeholder for recursive types
+			defs[t.Name()] = structSchema(t, defs)
+		}
+		ref := map[string]any{"$ref": "#/$defs/" + t.Name()}
+		if reflect.PointerTo(t).Implements(yamlUnmarshaler) {
+			// types with a custom unmarshaler also accept the shorthand string form
+			shorthand, ok := schemaShorthands[t.Name()]
+			if !ok {
+				shorthand = "string"
+			}
+			return map[string]any{"anyOf": []any{map[string]any{"type": shorthand}, ref}}
+		}
+		return ref
+	default:
+		return map[string]any{}
+	}
+}
+
+func structSchema(t reflect.Type, defs map[string]any) map[string]any {
+	properties := make(map[string]any)
+	for name, ft := range yamlFields(t) {
+		prop := typeSchema(ft, defs)
+		if values, ok := schemaEnums[name]; ok && ft.Kind() == reflect.String {
+			prop["enum"] = values
+		}
+		properties[name] = prop
+	}
+
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
@@ -0,0 +1,24 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestSchemaFileIsUpToDate(t *testing.T) {
+	expected, err := json.MarshalIndent(JSONSchema(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, '\n')
+
+	actual, err := os.ReadFile("../../dotfiles.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Error("dotfiles.schema.json is outdated, run go generate ./...")
+	}
+}
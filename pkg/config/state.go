@@ -2,54 +2,154 @@ package config
 
 import (
 	"encoding/json"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
 	"github.com/adrg/xdg"
 )
 
+// StateVersion is the current version of the state file format
+const StateVersion = 2
+
 type DotfileState struct {
-	Theme        string       `json:"theme"`
-	ActiveTheme  *ThemeConfig `json:"active_theme"`
-	Source       string       `json:"source"`
-	ManagedFiles []string     `json:"managed_files"`
+	Version      int           `json:"version"`
+	Theme        string        `json:"theme"`
+	Profile      string        `json:"profile,omitempty"` // profile of the last install
+	ActiveTheme  *ThemeConfig  `json:"active_theme"`
+	Source       string        `json:"source"`
+	Mode         string        `json:"mode,omitempty"` // global mode of the last install (copy, symlink)
+	ManagedFiles []ManagedFile `json:"managed_files"`
+	Backups      []Backup      `json:"backups,omitempty"`
+	Generation   int           `json:"generation,omitempty"` // id of the generation matching the managed files
+}
+
+// ManagedFile records how a managed target was produced
+type ManagedFile struct {
+	Target      string    `json:"target"`
+	Source      string    `json:"source,omitempty"`
+	Mode        string    `json:"mode,omitempty"`   // copy, symlink or template
+	Dir         string    `json:"dir,omitempty"`    // path of the directory entry that produced the file
+	Hash        string    `json:"sha256,omitempty"` // sha256 of the written content (copy and template only)
+	InstalledAt time.Time `json:"installed_at,omitzero"`
+}
+
+// Backup records an unmanaged file that was moved to the backup store before it was replaced
+type Backup struct {
+	Target    string    `json:"target"`
+	Path      string    `json:"path"` // location of the file in the backup store
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UnmarshalJSON supports the plain target paths used by state files before version 2
+func (m *ManagedFile) UnmarshalJSON(data []byte) error {
+	var target string
+	if err := json.Unmarshal(data, &target); err == nil {
+		*m = ManagedFile{Target: target}
+		return nil
+	}
+
+	type plain ManagedFile
+	return json.Unmarshal(data, (*plain)(m))
+}
+
+// ManagedTargets returns the target paths of all managed files
+func (s *DotfileState) ManagedTargets() []string {
+	targets := make([]string, 0, len(s.ManagedFiles))
+	for _, f := range s.ManagedFiles {
+		targets = append(targets, f.Target)
+	}
+	return targets
+}
+
+// GetManagedFile returns the managed file record for the target, or nil if the target is not managed
+func (s *DotfileState) GetManagedFile(target string) *ManagedFile {
+	for i := range s.ManagedFiles {
+		if s.ManagedFiles[i].Target == target {
+			return &s.ManagedFiles[i]
+		}
+	}
+	return nil
 }
 
 func StateFile() string {
+	return StateFileFor("")
+}
+
+// StateFileFor returns the state file for the home directory, the XDG state directory is used if home is empty
+func StateFileFor(home string) string {
 	if v := os.Getenv("DOTFILE_STATE_FILE"); v != "" {
 		return os.ExpandEnv(v)
 	}
+	if home != "" {
+		return filepath.Join(home, ".local", "state", "dotfiles", "state.json")
+	}
 	return filepath.Join(xdg.StateHome, "dotfiles", "state.json")
 }
 
-func LoadState(file string) (*DotfileState, error) {
+// Store provides the state file, backups and generations on the filesystem the dotfiles are installed to
+type Store struct {
+	FS        util.FS
+	StateFile string
+}
+
+func NewStore(fsys util.FS, stateFile string) *Store {
+	return &Store{FS: fsys, StateFile: stateFile}
+}
+
+// BackupDir returns the backup store, located next to the state file
+func (st *Store) BackupDir() string {
+	return filepath.Join(filepath.Dir(st.StateFile), "backups")
+}
+
+// GetBackups returns all backups of the target, the most recent one last
+func (s *DotfileState) GetBackups(target string) []Backup {
+	var backups []Backup
+	for _, b := range s.Backups {
+		if b.Target == target {
+			backups = append(backups, b)
+		}
+	}
+	return backups
+}
+
+func (st *Store) LoadState() (*DotfileState, error) {
 	s := &DotfileState{
-		ManagedFiles: []string{},
+		Version:      StateVersion,
+		ManagedFiles: []ManagedFile{},
 	}
 
 	// if file does not exist, return empty state
-	if _, err := os.Stat(file); os.IsNotExist(err) {
+	if _, err := st.FS.Stat(st.StateFile); os.IsNotExist(err) {
 		return s, nil
 	}
 
 	// read file
-	data, err := os.ReadFile(file)
+	data, err := st.FS.ReadFile(st.StateFile)
 	if err != nil {
 		return s, err
 	}
 
 	// unmarshal
+	s.Version = 0
 	if err := json.Unmarshal(data, &s); err != nil {
 		return s, err
 	}
 
+	// migrate older state files, legacy managed files only contain the target
+	if s.Version < StateVersion {
+		slog.Debug("migrating state file", "file", st.StateFile, "from", s.Version, "to", StateVersion)
+		s.Version = StateVersion
+	}
+
 	return s, nil
 }
 
-func SaveState(file string, state *DotfileState) error {
+func (st *Store) SaveState(state *DotfileState) error {
 	// create state directory
-	err := util.CreateParentDirectory(file)
+	err := util.CreateParentDirectory(st.FS, st.StateFile)
 	if err != nil {
 		return err
 	}
@@ -59,7 +159,7 @@ func SaveState(file string, state *DotfileState) error {
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(file, data, 0644); err != nil {
+	if err := st.FS.WriteFile(st.StateFile, data, 0644); err != nil {
 		return err
 	}
 
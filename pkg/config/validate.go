@@ -0,0 +1,455 @@
+package config
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+	"gopkg.in/yaml.v3"
+)
+
+// Position locates an entry in a configuration file
+type Position struct {
+	File   string `json:"file"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+}
+
+func (p Position) String() string {
+	if p.Line == 0 {
+		return p.File
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// Problem severities
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Problem is an issue found while validating the configuration
+type Problem struct {
+	Position
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.Position, p.Severity, p.Message)
+}
+
+// HasErrors checks if any of the problems is an error
+func HasErrors(problems []Problem) bool {
+	return slices.ContainsFunc(problems, func(p Problem) bool {
+		return p.Severity == SeverityError
+	})
+}
+
+var yamlLineRegex = regexp.MustCompile(`line (\d+)`)
+
+// ValidateOptions resolves rules and paths the same way as an install
+type ValidateOptions struct {
+	Rules RuleOptions
+	Vars  map[string]string // variables for ${name} in theme and link sources
+}
+
+// validator collects the problems of a configuration file and its includes
+type validator struct {
+	source   string
+	ctx      RuleContext
+	vars     map[string]string
+	rules    *RuleEngine
+	opts     LoadOptions
+	visited  map[string]bool
+	dirIDs   map[string]bool // ids of the directories defined by the files validated so far, in load order
+	problems []Problem
+}
+
+// Validate checks the configuration file and all includes without installing anything.
+// Directory paths and sources are resolved against the source directory, rules are evaluated with the rule context.
+// Unknown keys are reported as warnings if the load options downgrade them.
+func Validate(file string, source string, ctx RuleContext, validateOpts ValidateOptions, opts LoadOptions) []Problem {
+	v := &validator{source: source, ctx: ctx, vars: validateOpts.Vars, opts: opts, visited: make(map[string]bool), dirIDs: make(map[string]bool)}
+	rules, err := NewRuleEngineWithOptions(ctx, validateOpts.Rules)
+	if err != nil {
+		return []Problem{{Position: Position{File: file}, Severity: SeverityError, Message: err.Error()}}
+	}
+	v.rules = rules
+	v.validateFile(file, true, nil)
+	return v.problems
+}
+
+func (v *validator) add(file string, node *yaml.Node, severity string, format string, args ...any) {
+	pos := Position{File: file}
+	if node != nil {
+		pos.Line, pos.Column = node.Line, node.Column
+	}
+	v.problems = append(v.problems, Problem{Position: pos, Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+// addYAMLError reports a parser or decoder error, yaml.v3 only includes the line in the message
+func (v *validator) addYAMLError(file string, msg string) {
+	pos := Position{File: file}
+	if m := yamlLineRegex.FindStringSubmatch(msg); m != nil {
+		pos.Line, _ = strconv.Atoi(m[1])
+		pos.Column = 1
+	}
+	msg = strings.TrimPrefix(msg, "yaml: ")
+	msg = yamlLineRegex.ReplaceAllString(msg, "")
+	msg = strings.TrimLeft(msg, ": ")
+	v.problems = append(v.problems, Problem{Position: pos, Severity: SeverityError, Message: msg})
+}
+
+func (v *validator) validateFile(file string, require bool, chain []string) {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		v.add(file, nil, SeverityError, "failed to resolve path: %v", err)
+		return
+	}
+	if v.visited[absFile] {
+		return
+	}
+	v.visited[absFile] = true
+	chain = append(slices.Clone(chain), absFile)
+	start := len(v.problems)
+
+	// read file
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) && !require {
+		return
+	} else if err != nil {
+		v.add(file, nil, SeverityError, "failed to read file: %v", err)
+		return
+	}
+
+	// parse
+	var node yaml.Node
+	if err := yaml.Unmarshal(content, &node); err != nil {
+		v.addYAMLError(file, err.Error())
+		return
+	}
+	root := documentRoot(&node)
+	if root == nil {
+		return
+	}
+	severity := SeverityError
+	if v.opts.UnknownKeys == UnknownKeysWarn {
+		severity = SeverityWarning
+	}
+	for _, e := range unknownKeys(file, root, reflect.TypeOf(DotfilesConfig{})) {
+		v.problems = append(v.problems, Problem{Position: e.Position, Severity: severity, Message: e.Message()})
+	}
+
+	var cfg DotfilesConfig
+	if err := root.Decode(&cfg); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			v.addYAMLError(file, err.Error())
+			return
+		}
+		for _, msg := range typeErr.Errors {
+			v.addYAMLError(file, msg)
+		}
+	}
+
+	// themes
+	_, themesNode := mappingValue(root, "themes")
+	for i, theme := range cfg.Themes {
+		themeNode := sequenceItem(themesNode, i)
+		if theme.Name == "" {
+			v.add(file, themeNode, SeverityError, "theme name is required")
+		}
+		v.validateEnum(file, themeNode, "merge", theme.Merge, MergeStrategies)
+		_, commandsNode := mappingValue(themeNode, "commands")
+		v.validateCommands(file, commandsNode, theme.Commands)
+	}
+	// profiles
+	_, profilesNode := mappingValue(root, "profiles")
+	for i, profile := range cfg.Profiles {
+		profileNode := sequenceItem(profilesNode, i)
+		if profile.Name == "" {
+			v.add(file, profileNode, SeverityError, "profile name is required")
+		}
+		v.validateEnum(file, profileNode, "merge", profile.Merge, MergeStrategies)
+		_, variablesNode := mappingValue(profileNode, "variables")
+		v.validateVariables(file, variablesNode, profile.Variables)
+	}
+
+	// variables
+	_, variablesNode := mappingValue(root, "variables")
+	v.validateVariables(file, variablesNode, cfg.Variables)
+	_, hostsNode := mappingValue(root, "hosts")
+	for name, host := range cfg.Hosts {
+		_, hostNode := mappingValue(hostsNode, name)
+		_, variablesNode := mappingValue(hostNode, "variables")
+		v.validateVariables(file, variablesNode, host.Variables)
+	}
+
+	_, commandsNode := mappingValue(root, "activationCommands")
+	v.validateCommands(file, commandsNode, cfg.Commands)
+
+	// directories, named directories with an id of a previous file patch it like in mergeConfigs
+	_, dirsNode := mappingValue(root, "directories")
+	var defined, removed []string
+	for i, dir := range cfg.Directories {
+		strategy := dir.Merge
+		if strategy == "" && dir.Name != "" && v.dirIDs[dir.ID()] {
+			strategy = MergePatch
+		}
+		v.validateDir(file, sequenceItem(dirsNode, i), dir, strategy)
+
+		if strategy == MergeRemove {
+			removed = append(removed, dir.ID())
+		} else {
+			defined = append(defined, dir.ID())
+		}
+	}
+	for _, id := range defined {
+		v.dirIDs[id] = true
+	}
+	for _, id := range removed {
+		delete(v.dirIDs, id)
+	}
+
+	slices.SortStableFunc(v.problems[start:], func(a, b Problem) int {
+		return cmp.Compare(a.Line, b.Line)
+	})
+
+	// includes
+	_, includesNode := mappingValue(root, "includes")
+	for i, include := range cfg.Includes {
+		includeNode := sequenceItem(includesNode, i)
+		includePaths, err := resolveInclude(filepath.Dir(absFile), include)
+		if err != nil {
+			v.add(file, includeNode, SeverityError, "%v", err)
+			continue
+		}
+		for _, includePath := range includePaths {
+			if cycle := includeCycle(chain, includePath); cycle != "" {
+				v.add(file, includeNode, SeverityError, "include cycle: %s", cycle)
+				continue
+			}
+			v.validateFile(includePath, true, chain)
+		}
+	}
+}
+
+func (v *validator) validateVariables(file string, node *yaml.Node, variables map[string]Variable) {
+	for _, name := range slices.Sorted(maps.Keys(variables)) {
+		variable := variables[name]
+		variableNode, _ := mappingValue(node, name)
+		set := 0
+		for _, ok := range []bool{variable.Value != nil, variable.Expr != "", variable.Command != ""} {
+			if ok {
+				set++
+			}
+		}
+		if set > 1 {
+			v.add(file, variableNode, SeverityError, "variable %s must only set one of value, expr or command", name)
+		}
+	}
+}
+
+func (v *validator) validateCommands(file string, node *yaml.Node, commands []ThemeCommand) {
+	for i, cmd := range commands {
+		cmdNode := sequenceItem(node, i)
+		if cmd.Command == "" {
+			v.add(file, cmdNode, SeverityError, "command is required")
+		}
+		if cmd.Condition != "" {
+			if _, err := v.rules.Eval(cmd.Condition, ""); err != nil {
+				_, conditionNode := mappingValue(cmdNode, "condition")
+				v.add(file, conditionNode, SeverityError, "invalid condition %q: %v", cmd.Condition, err)
+			}
+		}
+	}
+}
+
+func (v *validator) validateDir(file string, node *yaml.Node, dir Dir, strategy string) {
+	// mode, conflict policy and merge strategy
+	v.validateEnum(file, node, "mode", dir.Mode, Modes)
+	v.validateEnum(file, node, "conflict", dir.Conflict, ConflictPolicies)
+	v.validateEnum(file, node, "merge", dir.Merge, MergeStrategies)
+
+	// removed directories only need the id, patches only the fields they override
+	if strategy == MergeRemove || (strategy == MergePatch && dir.Path == "") {
+		return
+	}
+
+	// target
+	if dir.Target == "" && strategy != MergePatch {
+		if id := dir.ID(); id != "" {
+			v.add(file, node, SeverityError, "directory %s has no target", id)
+		} else {
+			v.add(file, node, SeverityError, "directory has no target")
+		}
+	}
+
+	// source directory, the first existing alternative path is used if path does not exist
+	fullPath := v.sourcePath(dir.Path)
+	if !exists(fullPath) {
+		found := false
+		for _, p := range dir.Paths {
+			if fp := v.sourcePath(p); exists(fp) {
+				fullPath, found = fp, true
+				break
+			}
+		}
+		if !found {
+			pathKey, _ := mappingValue(node, "path")
+			if pathKey == nil {
+				pathKey = node
+			}
+			v.add(file, pathKey, SeverityError, "source directory %s does not exist", fullPath)
+		}
+	}
+
+	// ignore files
+	if _, err := util.GetAllFiles(fullPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		v.add(file, node, SeverityError, "%v", err)
+	}
+
+	// rules
+	v.validateRules(file, node, "rules", dir.Rules, fullPath)
+	v.validateRules(file, node, "fileRules", dir.FileRules, fullPath)
+
+	// template files
+	_, templatesNode := mappingValue(node, "templateFiles")
+	for i, tf := range dir.TemplateFiles {
+		v.validateTemplate(file, sequenceItem(templatesNode, i), v.sourcePath(tf))
+	}
+	if dir.Mode == "template" {
+		files, _ := util.GetAllFiles(fullPath)
+		for _, f := range files {
+			v.validateTemplate(file, node, f)
+		}
+	}
+
+	// theme files
+	_, themeFilesNode := mappingValue(node, "themeFiles")
+	for i, tf := range dir.ThemeFiles {
+		tfNode := sequenceItem(themeFilesNode, i)
+		if tf.Target == "" {
+			v.add(file, tfNode, SeverityError, "theme file has no target")
+		}
+		if len(tf.Sources) == 0 {
+			v.add(file, tfNode, SeverityError, "theme file %s has no sources", tf.Target)
+		}
+		_, sourcesNode := mappingValue(tfNode, "sources")
+		for _, theme := range slices.Sorted(maps.Keys(tf.Sources)) {
+			if p := util.ExpandPathRelativeVars(tf.Sources[theme], fullPath, "", v.vars); !exists(p) {
+				_, srcNode := mappingValue(sourcesNode, theme)
+				v.add(file, srcNode, SeverityError, "theme source %s does not exist", p)
+			}
+		}
+		v.validateRules(file, tfNode, "rules", tf.Rules, fullPath)
+	}
+
+	// link files
+	_, linkFilesNode := mappingValue(node, "linkFiles")
+	for i, lf := range dir.LinkFiles {
+		lfNode := sequenceItem(linkFilesNode, i)
+		v.validateEnum(file, lfNode, "mode", lf.Mode, Modes)
+		v.validateEnum(file, lfNode, "conflict", lf.Conflict, ConflictPolicies)
+		if lf.Target == "" {
+			v.add(file, lfNode, SeverityError, "link file has no target")
+		}
+		if !slices.ContainsFunc(lf.Paths, func(p string) bool { return exists(util.ExpandPathRelativeVars(p, fullPath, "", v.vars)) }) {
+			v.add(file, lfNode, SeverityWarning, "no source file found for %s (paths: %s)", lf.Target, strings.Join(lf.Paths, ", "))
+		}
+		v.validateRules(file, lfNode, "rules", lf.Rules, fullPath)
+	}
+}
+
+func (v *validator) validateRules(file string, node *yaml.Node, key string, rules []Rules, fullPath string) {
+	_, rulesNode := mappingValue(node, key)
+	for i, r := range rules {
+		if _, err := v.rules.Eval(r.Rule, fullPath); err != nil {
+			_, ruleNode := mappingValue(sequenceItem(rulesNode, i), "rule")
+			v.add(file, ruleNode, SeverityError, "invalid rule %q: %v", r.Rule, err)
+		}
+		_, excludeNode := mappingValue(sequenceItem(rulesNode, i), "exclude")
+		for j, exclude := range r.Exclude {
+			if _, err := util.ParsePatterns([]string{exclude}); err != nil {
+				v.add(file, sequenceItem(excludeNode, j), SeverityError, "%v", err)
+			}
+		}
+	}
+}
+
+func (v *validator) validateEnum(file string, node *yaml.Node, key string, value string, allowed []string) {
+	if value == "" || slices.Contains(allowed, value) {
+		return
+	}
+	_, valueNode := mappingValue(node, key)
+	v.add(file, valueNode, SeverityError, "invalid %s %q (valid values: %s)", key, value, strings.Join(allowed, ", "))
+}
+
+func (v *validator) validateTemplate(file string, node *yaml.Node, path string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		v.add(file, node, SeverityError, "template file %s does not exist", path)
+		return
+	}
+	if _, err := util.ParseTemplate(path, content); err != nil {
+		v.add(file, node, SeverityError, "invalid template: %v", err)
+	}
+}
+
+func (v *validator) sourcePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(v.source, path)
+}
+
+// documentRoot returns the top-level node of a parsed document, or nil if the document is empty
+func documentRoot(node *yaml.Node) *yaml.Node {
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return nil
+		}
+		return node.Content[0]
+	}
+	if node.Kind == 0 {
+		return nil
+	}
+	return node
+}
+
+// mappingValue returns the key and value node of a mapping entry
+func mappingValue(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// sequenceItem returns the item of a sequence node, or nil if it does not exist
+func sequenceItem(node *yaml.Node, i int) *yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode || i >= len(node.Content) {
+		return nil
+	}
+	return node.Content[i]
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
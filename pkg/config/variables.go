@@ -0,0 +1,162 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+	"gopkg.in/yaml.v3"
+)
+
+// Variable is a value for rules, templates and target paths, either the plain value or an object with value, expr or command
+type Variable struct {
+	Value   interface{} `yaml:"value"`
+	Expr    string      `yaml:"expr"`    // CEL expression evaluated with the rule context
+	Command string      `yaml:"command"` // Shell command, the trimmed output is the value
+}
+
+// Host overrides values for a single machine, selected by its hostname
+type Host struct {
+	Variables map[string]Variable `yaml:"variables"`
+}
+
+// UnmarshalYAML supports plain values as shorthand for variables without expression or command
+func (v *Variable) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		*v = Variable{}
+		return node.Decode(&v.Value)
+	}
+
+	type plain Variable
+	return node.Decode((*plain)(v))
+}
+
+// ResolveVariables computes the variables of the configuration, overridden by the profile and the host.
+// Expressions can use the rule context and other variables, the variables they reference are resolved first.
+func (c *DotfilesConfig) ResolveVariables(ctx RuleContext, profile *Profile, hostname string, opts RuleOptions) (map[string]interface{}, error) {
+	definitions := maps.Clone(c.Variables)
+	if definitions == nil {
+		definitions = make(map[string]Variable)
+	}
+	if profile != nil {
+		maps.Copy(definitions, profile.Variables)
+	}
+	if host, ok := c.Hosts[hostname]; ok {
+		maps.Copy(definitions, host.Variables)
+	}
+
+	r := &variableResolver{
+		definitions: definitions,
+		ctx:         ctx,
+		opts:        opts,
+		values:      make(map[string]interface{}, len(definitions)),
+		resolving:   make(map[string]bool),
+	}
+	for _, name := range slices.Sorted(maps.Keys(definitions)) {
+		if err := r.resolve(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.values, nil
+}
+
+// variableResolver resolves variables on demand, so expressions can reference variables in any order
+type variableResolver struct {
+	definitions map[string]Variable
+	ctx         RuleContext
+	opts        RuleOptions
+	values      map[string]interface{}
+	resolving   map[string]bool // variables that are being resolved, to detect cycles
+}
+
+func (r *variableResolver) resolve(name string) error {
+	if _, ok := r.values[name]; ok {
+		return nil
+	}
+	if r.resolving[name] {
+		return &VariableError{Name: name, Err: errors.New("the expression depends on the variable itself")}
+	}
+	r.resolving[name] = true
+	defer delete(r.resolving, name)
+
+	v := r.definitions[name]
+	switch {
+	case v.Expr != "":
+		value, err := r.evalExpression(v.Expr)
+		if err != nil {
+			return &VariableError{Name: name, Err: err}
+		}
+		r.values[name] = value
+	case v.Command != "":
+		value, err := util.CommandOutput(v.Command)
+		if err != nil {
+			return &VariableError{Name: name, Err: err}
+		}
+		r.values[name] = value
+	default:
+		switch v.Value.(type) {
+		case string, bool, int, float64:
+			r.values[name] = v.Value
+		default:
+			return &VariableError{Name: name, Err: errors.New("the value must be a string, number or bool")}
+		}
+	}
+	return nil
+}
+
+// evalExpression evaluates a CEL expression with the rule context and the variables it references
+func (r *variableResolver) evalExpression(expression string) (interface{}, error) {
+	env, err := newCelEnv(r.ctx, r.opts, slices.Collect(maps.Keys(r.definitions))...)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("failed to compile expression: %w", issues.Err())
+	}
+
+	// resolve referenced variables first
+	for _, ref := range ast.NativeRep().ReferenceMap() {
+		if _, ok := r.definitions[ref.Name]; ok && len(ref.OverloadIDs) == 0 {
+			if err := r.resolve(ref.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct program: %w", err)
+	}
+	activation := maps.Clone(map[string]interface{}(r.ctx))
+	maps.Copy(activation, r.values)
+	out, _, err := prg.Eval(activation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate expression: %w", err)
+	}
+
+	switch value := out.Value().(type) {
+	case string, bool, int64, float64:
+		return value, nil
+	default:
+		return nil, errors.New("expression must return a string, bool, int or double, got " + out.Type().TypeName())
+	}
+}
+
+// VariableError is returned if the value of a variable can not be computed
+type VariableError struct {
+	Name string
+	Err  error
+}
+
+func (e *VariableError) Error() string {
+	return fmt.Sprintf("failed to resolve variable %s: %v", e.Name, e.Err)
+}
+
+func (e *VariableError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,70 @@
+package dotfiles
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+)
+
+// BackupFile moves the target into the backup store and records it in the state
+func BackupFile(store *config.Store, state *config.DotfileState, target string) (*config.Backup, error) {
+	now := time.Now().UTC()
+	backup := config.Backup{
+		Target:    target,
+		Path:      filepath.Join(store.BackupDir(), now.Format("20060102T150405.000000000Z"), target),
+		CreatedAt: now,
+	}
+
+	if err := util.MoveFile(store.FS, target, backup.Path); err != nil {
+		return nil, fmt.Errorf("failed to backup %s: %w", target, err)
+	}
+	state.Backups = append(state.Backups, backup)
+
+	return &backup, nil
+}
+
+// RestoreBackup moves the most recent backup of the target back into place.
+// A managed target is removed and no longer tracked, an unmanaged target is only replaced if force is set.
+func RestoreBackup(store *config.Store, state *config.DotfileState, target string, force bool) (*config.Backup, error) {
+	backups := state.GetBackups(target)
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no backup found for %s", target)
+	}
+	backup := backups[len(backups)-1]
+
+	if _, err := store.FS.Lstat(target); err == nil {
+		if state.GetManagedFile(target) == nil && !force {
+			return nil, fmt.Errorf("target %s exists and is not managed, use force to replace it", target)
+		}
+		if err := store.FS.Remove(target); err != nil {
+			return nil, fmt.Errorf("failed to remove %s: %w", target, err)
+		}
+	}
+
+	if err := util.MoveFile(store.FS, backup.Path, target); err != nil {
+		return nil, fmt.Errorf("failed to restore %s: %w", target, err)
+	}
+
+	// the restored file belongs to the user again
+	state.ManagedFiles = slices.DeleteFunc(state.ManagedFiles, func(f config.ManagedFile) bool {
+		return f.Target == target
+	})
+	state.Backups = slices.DeleteFunc(state.Backups, func(b config.Backup) bool {
+		return b.Target == backup.Target && b.Path == backup.Path
+	})
+
+	// remove empty directories left in the backup store
+	backupDir := store.BackupDir()
+	for dir := filepath.Dir(backup.Path); strings.HasPrefix(dir, backupDir+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if store.FS.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return &backup, nil
+}
@@ -0,0 +1,110 @@
+package dotfiles
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+)
+
+// Collision describes two files with the same priority that provide the same target, or a target inside the other target
+type Collision struct {
+	Target    string             `json:"target"`
+	Nested    string             `json:"nested,omitempty"` // target inside Target, empty if both provide Target
+	Sources   [2]string          `json:"sources"`
+	Positions [2]config.Position `json:"positions"`
+}
+
+func (c Collision) String() string {
+	if c.Nested != "" {
+		return fmt.Sprintf("%s from %s (%s) is inside %s from %s (%s)", c.Nested, c.Sources[1], c.Positions[1], c.Target, c.Sources[0], c.Positions[0])
+	}
+	return fmt.Sprintf("%s is provided by %s (%s) and %s (%s)", c.Target, c.Sources[0], c.Positions[0], c.Sources[1], c.Positions[1])
+}
+
+// resolveCollisions skips files whose target is provided by a file with higher priority.
+// Targets inside another target (e.g. a file below a linked file) are treated the same way.
+// Within a directory the file processed last wins, equal priorities of different directories are an error.
+func resolveCollisions(files []File) ([]File, error) {
+	var collisions []Collision
+
+	// same target, the file with the highest priority wins
+	winners := make(map[string]int) // target -> index of the winning file
+	for i, f := range files {
+		if f.Reason != "" {
+			continue
+		}
+		w, ok := winners[f.Target]
+		if !ok {
+			winners[f.Target] = i
+			continue
+		}
+
+		switch {
+		case sameDir(f, files[w]):
+			files[w].Reason = overriddenInDirReason(f)
+			winners[f.Target] = i
+		case f.priority > files[w].priority:
+			files[w].Reason = overriddenReason(f)
+			winners[f.Target] = i
+		case f.priority < files[w].priority:
+			files[i].Reason = overriddenReason(files[w])
+		default:
+			collisions = append(collisions, Collision{
+				Target:    f.Target,
+				Sources:   [2]string{files[w].Source, f.Source},
+				Positions: [2]config.Position{files[w].pos, f.pos},
+			})
+		}
+	}
+
+	// target inside another target
+	for i, f := range files {
+		if f.Reason != "" {
+			continue
+		}
+		for dir := filepath.Dir(f.Target); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			p, ok := winners[dir]
+			if !ok || files[p].Reason != "" {
+				continue
+			}
+
+			switch {
+			case sameDir(f, files[p]) && i > p:
+				files[p].Reason = overriddenInDirReason(f)
+			case sameDir(f, files[p]):
+				files[i].Reason = overriddenInDirReason(files[p])
+			case f.priority > files[p].priority:
+				files[p].Reason = overriddenReason(f)
+			case f.priority < files[p].priority:
+				files[i].Reason = overriddenReason(files[p])
+			default:
+				collisions = append(collisions, Collision{
+					Target:    dir,
+					Nested:    f.Target,
+					Sources:   [2]string{files[p].Source, f.Source},
+					Positions: [2]config.Position{files[p].pos, f.pos},
+				})
+			}
+			break
+		}
+	}
+
+	if len(collisions) > 0 {
+		return files, &CollisionError{Collisions: collisions}
+	}
+	return files, nil
+}
+
+func overriddenReason(winner File) string {
+	return fmt.Sprintf("overridden by %s (priority %d)", winner.Dir, winner.priority)
+}
+
+func overriddenInDirReason(winner File) string {
+	return fmt.Sprintf("overridden by %s of the same directory", winner.Source)
+}
+
+// sameDir reports whether both files come from the same directory entry of the configuration
+func sameDir(a File, b File) bool {
+	return a.Dir == b.Dir && a.pos == b.pos
+}
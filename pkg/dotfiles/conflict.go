@@ -0,0 +1,65 @@
+package dotfiles
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+)
+
+// resolveConflicts turns conflict actions into replace or skip actions, prompting for each target if required.
+// It returns an error before any change is made if a target uses the fail policy.
+func resolveConflicts(plan *Plan, in io.Reader, out io.Writer) error {
+	var failed []string
+	for _, a := range plan.Actions {
+		if a.Type == ActionConflict && a.Conflict == config.ConflictFail {
+			failed = append(failed, a.Target)
+		}
+	}
+	if len(failed) > 0 {
+		return &ConflictError{Targets: failed}
+	}
+
+	interactive := in != nil && isTerminal(in)
+	var reader *bufio.Reader
+	if interactive {
+		reader = bufio.NewReader(in)
+	}
+	for i := range plan.Actions {
+		a := &plan.Actions[i]
+		if a.Type != ActionConflict {
+			continue
+		}
+
+		if !interactive {
+			a.Type = ActionSkip
+			a.Reason = conflictReason(*a) + ", no terminal to prompt"
+			continue
+		}
+
+		_, _ = fmt.Fprintf(out, "%s: %s - [s]kip, [o]verwrite or [b]ackup? ", a.Target, conflictReason(*a))
+		answer, _ := reader.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "o", "overwrite":
+			*a = conflictAction(*a, config.ConflictOverwrite)
+		case "b", "backup":
+			*a = conflictAction(*a, config.ConflictBackup)
+		default:
+			*a = conflictAction(*a, config.ConflictSkip)
+		}
+	}
+
+	return nil
+}
+
+func isTerminal(in io.Reader) bool {
+	f, ok := in.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
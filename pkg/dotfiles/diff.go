@@ -0,0 +1,59 @@
+package dotfiles
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+)
+
+func (s *session) diff(plan *Plan) (string, error) {
+	var sb strings.Builder
+
+	for _, a := range plan.Actions {
+		switch a.Type {
+		case ActionCreate, ActionSymlink, ActionUpdate, ActionReplace:
+			expected := []byte(fmt.Sprintf("symlink -> %s\n", a.Source))
+			if a.Mode != "symlink" {
+				content, err := util.ReadSource(a.Source, a.Mode, s.properties)
+				if err != nil {
+					return "", fmt.Errorf("failed to render %s: %w", a.Source, err)
+				}
+				expected = content
+			}
+
+			current, exists := diffContent(s.fs, a.Target)
+			fromName := a.Target
+			if !exists {
+				fromName = "/dev/null"
+			}
+			sb.WriteString(util.UnifiedDiff(fromName, a.Target, current, expected))
+		case ActionDelete:
+			if current, exists := diffContent(s.fs, a.Target); exists {
+				sb.WriteString(util.UnifiedDiff(a.Target, "/dev/null", current, nil))
+			}
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// diffContent returns the content of a target for diffing, symlinks are represented by their destination
+func diffContent(fsys util.FS, path string) ([]byte, bool) {
+	info, err := fsys.Lstat(path)
+	if err != nil {
+		return nil, false
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, _ := fsys.Readlink(path)
+		return []byte(fmt.Sprintf("symlink -> %s\n", link)), true
+	}
+
+	content, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, true
+	}
+	return content, true
+}
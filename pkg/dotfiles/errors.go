@@ -0,0 +1,77 @@
+package dotfiles
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoSource is returned if no source directory is given and none is stored in the state
+var ErrNoSource = errors.New("provide the source directory as first argument")
+
+// StateError is returned if the state file can not be read or written
+type StateError struct {
+	File string
+	Err  error
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("state file %s: %v", e.File, e.Err)
+}
+
+func (e *StateError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError is returned if the configuration can not be loaded or is invalid
+type ConfigError struct {
+	File string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("config file %s: %v", e.File, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConflictError is returned if unmanaged or locally modified targets exist and the conflict policy is fail
+type ConflictError struct {
+	Targets []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("targets exist and are not managed or were edited since install: %s", strings.Join(e.Targets, ", "))
+}
+
+// ApplyError is returned if a change could not be applied, all changes of the install or rollback were rolled back
+type ApplyError struct {
+	Target string
+	Err    error
+}
+
+func (e *ApplyError) Error() string {
+	if e.Target == "" {
+		return fmt.Sprintf("failed to apply changes, changes were rolled back: %v", e.Err)
+	}
+	return fmt.Sprintf("failed to apply %s, changes were rolled back: %v", e.Target, e.Err)
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// CollisionError is returned if several files with the same priority provide the same or overlapping targets
+type CollisionError struct {
+	Collisions []Collision
+}
+
+func (e *CollisionError) Error() string {
+	var messages []string
+	for _, c := range e.Collisions {
+		messages = append(messages, c.String())
+	}
+	return fmt.Sprintf("target collisions, set a priority on the directories to choose one: %s", strings.Join(messages, "; "))
+}
@@ -0,0 +1,222 @@
+package dotfiles
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+)
+
+// recordGeneration snapshots the content of all managed copies and templates and stores a new generation
+func recordGeneration(store *config.Store, state *config.DotfileState, description string) error {
+	managedFiles := slices.Clone(state.ManagedFiles)
+	for i, f := range managedFiles {
+		if f.Mode == "symlink" || f.Hash == "" {
+			continue
+		}
+
+		content, err := store.FS.ReadFile(f.Target)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot %s: %w", f.Target, err)
+		}
+		hash, err := store.SaveSnapshot(content)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot %s: %w", f.Target, err)
+		}
+		managedFiles[i].Hash = hash
+	}
+
+	// nothing changed since the current generation
+	if current, err := store.LoadGeneration(state.Generation); err == nil && current.Theme == state.Theme && current.Profile == state.Profile && sameFiles(current.ManagedFiles, managedFiles) {
+		return nil
+	}
+
+	g := &config.Generation{
+		CreatedAt:    time.Now().UTC(),
+		Source:       state.Source,
+		SourceCommit: sourceCommit(state.Source),
+		Mode:         state.Mode,
+		Theme:        state.Theme,
+		Profile:      state.Profile,
+		ActiveTheme:  state.ActiveTheme,
+		ManagedFiles: managedFiles,
+		Description:  description,
+	}
+	if hash, err := util.HashFile(util.OSFS{}, filepath.Join(state.Source, "dotfiles.yaml")); err == nil {
+		g.ConfigHash = hash
+	}
+	if err := store.SaveGeneration(g); err != nil {
+		return err
+	}
+	state.Generation = g.ID
+
+	return nil
+}
+
+func sameFiles(a []config.ManagedFile, b []config.ManagedFile) bool {
+	return slices.EqualFunc(a, b, func(x, y config.ManagedFile) bool {
+		return x.Target == y.Target && x.Source == y.Source && x.Mode == y.Mode && x.Hash == y.Hash
+	})
+}
+
+// sourceCommit returns the git commit of the source directory, or an empty string if it is not a git repository
+func sourceCommit(source string) string {
+	out, err := exec.Command("git", "-C", source, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Rollback restores the managed files to exactly what an earlier generation produced.
+// If id is 0, the generation before the current one is restored.
+func Rollback(store *config.Store, id int) (*config.Generation, error) {
+	// load state
+	state, err := store.LoadState()
+	if err != nil {
+		return nil, &StateError{File: store.StateFile, Err: err}
+	}
+
+	// determine generation
+	if id == 0 {
+		generations, err := store.ListGenerations()
+		if err != nil {
+			return nil, err
+		}
+		current := state.Generation
+		if current == 0 && len(generations) > 0 {
+			current = generations[len(generations)-1].ID
+		}
+		for _, g := range generations {
+			if g.ID < current {
+				id = g.ID
+			}
+		}
+		if id == 0 {
+			return nil, fmt.Errorf("no previous generation found")
+		}
+	}
+	g, err := store.LoadGeneration(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// stage all files of the generation, nothing is changed if a snapshot is missing
+	tx := newTransaction(store.FS)
+	var restore []config.ManagedFile
+	for _, f := range g.ManagedFiles {
+		if isRestored(store.FS, f) {
+			continue
+		}
+		if err := stageManagedFile(store, tx, f); err != nil {
+			return nil, &ApplyError{Target: f.Target, Err: errors.Join(err, tx.rollback())}
+		}
+		if _, ok := tx.staged[f.Target]; ok {
+			restore = append(restore, f)
+		}
+	}
+
+	// move managed files that are not part of the generation aside, edited files into the backup store, files that can not be removed stay managed
+	var failedToDelete []config.ManagedFile
+	for _, f := range state.ManagedFiles {
+		if slices.ContainsFunc(g.ManagedFiles, func(gf config.ManagedFile) bool { return gf.Target == f.Target }) {
+			continue
+		}
+		var err error
+		if needsBackup(store.FS, state, f.Target) {
+			err = tx.backup(store, state, f.Target)
+		} else {
+			err = tx.moveAside(f.Target)
+		}
+		if err != nil {
+			slog.Debug("failed to remove file", "file", f.Target, "err", err)
+			failedToDelete = append(failedToDelete, f)
+		}
+	}
+
+	// restore files, unmanaged and locally modified targets are moved to the backup store
+	for _, f := range restore {
+		var err error
+		if needsBackup(store.FS, state, f.Target) {
+			err = tx.backup(store, state, f.Target)
+		} else {
+			err = tx.moveAside(f.Target)
+		}
+		if err == nil {
+			err = tx.place(f.Target)
+		}
+		if err != nil {
+			return nil, &ApplyError{Target: f.Target, Err: errors.Join(err, tx.rollback())}
+		}
+	}
+
+	// state
+	state.Source = g.Source
+	state.Mode = g.Mode
+	state.Theme = g.Theme
+	state.Profile = g.Profile
+	state.ActiveTheme = g.ActiveTheme
+	state.ManagedFiles = append(slices.Clone(g.ManagedFiles), failedToDelete...)
+	if err := store.SaveState(state); err != nil {
+		return nil, &ApplyError{Err: errors.Join(&StateError{File: store.StateFile, Err: err}, tx.rollback())}
+	}
+	tx.commit()
+
+	// history
+	if err := recordGeneration(store, state, fmt.Sprintf("rollback to generation %d", g.ID)); err != nil {
+		slog.Warn("failed to record generation", "err", err)
+	} else if err := store.SaveState(state); err != nil {
+		slog.Warn("failed to save state", "err", err)
+	}
+
+	return g, nil
+}
+
+// needsBackup reports whether the target has content that is not recorded anywhere, an unmanaged file or a managed file edited since install
+func needsBackup(fsys util.FS, state *config.DotfileState, target string) bool {
+	info, err := fsys.Lstat(target)
+	if err != nil {
+		return false
+	}
+	managed := state.GetManagedFile(target)
+	return managed == nil || isModified(fsys, managed, info)
+}
+
+// isRestored reports whether the target already is the symlink or has the snapshot content of the managed file
+func isRestored(fsys util.FS, f config.ManagedFile) bool {
+	info, err := fsys.Lstat(f.Target)
+	if err != nil {
+		return false
+	}
+	if f.Mode == "symlink" {
+		link, _ := fsys.Readlink(f.Target)
+		return info.Mode()&os.ModeSymlink != 0 && link == f.Source
+	}
+	hash, _ := util.HashFile(fsys, f.Target)
+	return info.Mode().IsRegular() && hash == f.Hash
+}
+
+// stageManagedFile stages the symlink or the snapshot of a copy, copies without snapshot are skipped
+func stageManagedFile(store *config.Store, tx *transaction, f config.ManagedFile) error {
+	if f.Mode == "symlink" {
+		return tx.stage(f.Source, f.Target, "symlink", nil)
+	}
+
+	if f.Hash == "" {
+		slog.Warn("no snapshot available, skipping", "target", f.Target)
+		return nil
+	}
+	content, err := store.LoadSnapshot(f.Hash)
+	if err != nil {
+		return err
+	}
+	return tx.stageContent(f.Target, content, f.Source)
+}
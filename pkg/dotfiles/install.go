@@ -3,118 +3,186 @@ package dotfiles
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"slices"
+	"time"
 
 	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
 	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
-	"github.com/cidverse/go-rules/pkg/expr"
-	"github.com/iancoleman/strcase"
 )
 
 type File struct {
 	Source         string
 	Target         string
+	Mode           string // copy, symlink or template
+	Dir            string // path of the directory entry the file belongs to
+	Conflict       string // policy for an existing target that is not managed
 	IsTemplateFile bool
+	Reason         string // reason why the file is skipped, empty if the file is installed
+	pos            config.Position
+	priority       int
 }
 
-func Install(dir string, mode string, dryRun bool, extraContext map[string]interface{}, themeOverride string) error {
-	// load state
-	stateFile := config.StateFile()
-	if err := util.CreateParentDirectory(stateFile); err != nil {
-		slog.Error("failed to create state directory", "file", stateFile, "err", err)
-		os.Exit(1)
-	}
-	state, err := config.LoadState(stateFile)
-	if err != nil {
-		slog.Error("failed to parse state file", "file", stateFile, "err", err)
-		os.Exit(1)
+// apply executes the plan as a transaction and persists the state before running theme activation commands.
+// All files are staged first, on error every change is rolled back and the state file is left untouched.
+func (s *session) apply(plan *Plan) error {
+	state := s.state
+	tx := newTransaction(s.fs)
+
+	// stage all writes, nothing is changed if rendering fails
+	for _, a := range plan.Actions {
+		switch a.Type {
+		case ActionCreate, ActionSymlink, ActionUpdate, ActionReplace:
+			if err := tx.stage(a.Source, a.Target, a.Mode, s.properties); err != nil {
+				return &ApplyError{Target: a.Target, Err: errors.Join(err, tx.rollback())}
+			}
+		}
 	}
 
-	// source dir (first arg or from state)
-	var source string
-	if dir != "" {
-		source = dir
-	} else if state.Source != "" {
-		source = state.Source
-	} else {
-		slog.Error("provide the source directory as first argument")
-		os.Exit(1)
+	// commit
+	var managedFiles []config.ManagedFile
+	var failedToDelete []config.ManagedFile
+	for _, a := range plan.Actions {
+		switch a.Type {
+		case ActionKeep:
+			managedFiles = append(managedFiles, managedFileRecord(s.fs, a.file(), state.GetManagedFile(a.Target)))
+		case ActionCreate, ActionSymlink, ActionUpdate, ActionReplace:
+			// unmanaged targets are moved into the backup store whatever policy replaces them, managed targets aside
+			var err error
+			if a.Conflict == config.ConflictBackup || state.GetManagedFile(a.Target) == nil && exists(s.fs, a.Target) {
+				err = tx.backup(s.store, state, a.Target)
+			} else {
+				err = tx.moveAside(a.Target)
+			}
+			if err == nil {
+				err = tx.place(a.Target)
+			}
+			if err != nil {
+				return &ApplyError{Target: a.Target, Err: errors.Join(err, tx.rollback())}
+			}
+			slog.Debug("process file", "action", a.Type, "source", a.Source, "target", a.Target, "mode", a.Mode, "reason", a.Reason)
+
+			// state
+			managedFiles = append(managedFiles, managedFileRecord(s.fs, a.file(), nil))
+		case ActionDelete:
+			// edited files are moved into the backup store, files that can not be removed stay managed
+			var err error
+			if a.Conflict == config.ConflictBackup {
+				err = tx.backup(s.store, state, a.Target)
+			} else {
+				err = tx.moveAside(a.Target)
+			}
+			if err != nil {
+				slog.Debug("failed to remove file", "file", a.Target, "err", err)
+				if mf := state.GetManagedFile(a.Target); mf != nil {
+					failedToDelete = append(failedToDelete, *mf)
+				}
+			}
+		case ActionSkip:
+			// locally modified targets that are kept stay managed
+			if mf := state.GetManagedFile(a.Target); a.Modified && mf != nil {
+				managedFiles = append(managedFiles, *mf)
+			}
+			slog.Debug("skip", "target", a.Target, "command", a.Command, "reason", a.Reason)
+		}
 	}
-	state.Source = source
+	state.ManagedFiles = uniqueTargets(slices.Concat(managedFiles, failedToDelete, s.unselected))
 
-	// load config
-	conf, err := config.Load(filepath.Join(source, "dotfiles.yaml"), true)
-	if err != nil {
-		slog.Error("failed to parse config file", "file", filepath.Join(source, "dotfiles.yaml"), "err", err)
-		os.Exit(1)
+	// persist state (in case any of the commands query the state)
+	if err := s.store.SaveState(state); err != nil {
+		return &ApplyError{Err: errors.Join(&StateError{File: s.store.StateFile, Err: err}, tx.rollback())}
 	}
+	tx.commit()
 
-	// theme (env > flag, and falls back to persisted state; flag is only used when env is unset)
-	themeName := os.Getenv("DOTFILE_THEME")
-	if themeName == "" {
-		themeName = themeOverride
+	// history
+	if err := recordGeneration(s.store, state, "install"); err != nil {
+		slog.Warn("failed to record generation", "err", err)
+	} else if err := s.store.SaveState(state); err != nil {
+		slog.Warn("failed to save state", "err", err)
 	}
-	if themeName == "" {
-		themeName = state.Theme
+
+	// theme activation
+	for _, a := range plan.Actions {
+		if a.Type != ActionRunCommand {
+			continue
+		}
+
+		slog.Debug("executing theme command", "command", a.Command)
+		if err := util.RunCommand(a.Command); err != nil {
+			slog.Warn("failed to execute theme activation command", "command", a.Command, "err", err)
+		}
 	}
-	originalThemeName := state.Theme
-	state.Theme = themeName
-	theme := conf.GetTheme(themeName)
-	state.ActiveTheme = theme
 
-	// information
-	slog.Info("installing dotfiles", "dry-run", dryRun, "mode", mode, "source", source)
+	return nil
+}
+
+// uniqueTargets removes later records of the same target, so a file that was planned and also kept outside the selection is only recorded once
+func uniqueTargets(managedFiles []config.ManagedFile) []config.ManagedFile {
+	seen := make(map[string]bool, len(managedFiles))
+	return slices.DeleteFunc(managedFiles, func(mf config.ManagedFile) bool {
+		if seen[mf.Target] {
+			return true
+		}
+		seen[mf.Target] = true
+		return false
+	})
+}
 
-	// remove files
-	state.ManagedFiles = DeleteManagedFiles(state.ManagedFiles, dryRun)
+// exists reports whether the target exists, broken symlinks included
+func exists(fsys util.FS, target string) bool {
+	_, err := fsys.Lstat(target)
+	return err == nil
+}
 
-	// properties (built once, reused for all directories)
-	properties := map[string]string{
-		"Home": os.Getenv("HOME"),
-		"User": os.Getenv("USER"),
+// managedFileRecord creates the state record for an installed file, keeping the install time of unchanged files
+func managedFileRecord(fsys util.FS, f File, previous *config.ManagedFile) config.ManagedFile {
+	record := config.ManagedFile{
+		Target:      f.Target,
+		Source:      f.Source,
+		Mode:        f.Mode,
+		Dir:         f.Dir,
+		InstalledAt: time.Now().UTC(),
 	}
-	if theme != nil {
-		properties["Name"] = themeName
-		properties["ColorScheme"] = theme.ColorScheme
-		properties["WallpaperDir"] = theme.WallpaperDir
-		properties["FontFamily"] = theme.FontFamily
-		properties["FontSize"] = theme.FontSize
-		properties["GtkTheme"] = theme.GtkTheme
-		properties["IconTheme"] = theme.IconTheme
-		properties["CursorTheme"] = theme.CursorTheme
-		for k, v := range theme.Properties {
-			properties[strcase.ToCamel(k)] = v
-		}
+	if previous != nil && !previous.InstalledAt.IsZero() {
+		record.InstalledAt = previous.InstalledAt
 	}
 
-	// rule context (built once, reused for all files)
-	ruleCtx := config.BuildRuleContext()
-	for k, v := range extraContext {
-		ruleCtx[k] = v
-		switch val := v.(type) {
-		case string:
-			properties[strcase.ToCamel(k)] = val
-		case bool:
-			properties[strcase.ToCamel(k)] = fmt.Sprintf("%t", val)
-		case int64:
-			properties[strcase.ToCamel(k)] = fmt.Sprintf("%d", val)
-		case float64:
-			properties[strcase.ToCamel(k)] = fmt.Sprintf("%v", val)
+	if f.Mode != "symlink" {
+		if hash, err := util.HashFile(fsys, f.Target); err == nil {
+			record.Hash = hash
 		}
 	}
 
-	// process directories
-	for _, dir := range conf.Directories {
-		fullPath := calculateFullPath(source, dir.Path)
-		targetPath := util.ResolvePath(dir.Target)
+	return record
+}
+
+func calculateFullPath(source string, path string) string {
+	fullPath := path
+	if !filepath.IsAbs(path) && path != "" && path[0] != filepath.Separator {
+		fullPath = filepath.Join(source, path)
+	}
+	return fullPath
+}
+
+// collectFiles resolves all files the configuration would install, in processing order.
+func (s *session) collectFiles() ([]File, error) {
+	var result []File
+
+	for _, dir := range s.conf.Directories {
+		if !s.selects(dir) {
+			continue
+		}
+
+		fullPath := calculateFullPath(s.source, dir.Path)
+		targetPath := util.ExpandPathVars(dir.Target, s.home, s.vars)
 
 		// check alternative paths
 		if _, err := os.Stat(fullPath); os.IsNotExist(err) {
 			for _, p := range dir.Paths {
-				fp := calculateFullPath(source, p)
+				fp := calculateFullPath(s.source, p)
 				if _, err := os.Stat(fp); !os.IsNotExist(err) {
 					fullPath = fp
 					break
@@ -122,19 +190,45 @@ func Install(dir string, mode string, dryRun bool, extraContext map[string]inter
 			}
 		}
 
+		// directory rules are evaluated once, a directory that does not match is skipped as a whole without collecting its files
+		match, err := s.rules.Match(dir.Rules, fullPath)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			slog.Debug("directory rules do not match, skipping", "dir", dir.Path)
+			result = append(result, File{
+				Source:   fullPath,
+				Target:   targetPath,
+				Dir:      dir.Path,
+				pos:      dir.Pos,
+				priority: dir.Priority,
+				Reason:   "rule mismatch",
+			})
+			continue
+		}
+
+		excludes, err := config.NewExcludes(slices.Concat(dir.Rules, dir.FileRules), fullPath)
+		if err != nil {
+			return nil, err
+		}
+
 		// get all files in source
 		files, filesErr := util.GetAllFiles(fullPath)
-		if filesErr != nil {
-			slog.Info("source does not exist, skipping", "source", source, "err", filesErr)
+		if errors.Is(filesErr, fs.ErrNotExist) {
+			slog.Info("source does not exist, skipping", "source", s.source, "err", filesErr)
 			continue
 		}
+		if filesErr != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", fullPath, filesErr)
+		}
 
 		// process files
 		var filesToProcess []File
 		for _, file := range files {
 			relativeFile, fileErr := filepath.Rel(fullPath, file)
 			if fileErr != nil {
-				return errors.New("failed to determine relative file path for: " + file)
+				return nil, errors.New("failed to determine relative file path for: " + file)
 			}
 			targetFile := filepath.Join(targetPath, relativeFile)
 
@@ -147,27 +241,37 @@ func Install(dir string, mode string, dryRun bool, extraContext map[string]inter
 			filesToProcess = append(filesToProcess, File{
 				Source:         file,
 				Target:         targetFile,
+				Dir:            dir.Path,
+				pos:            dir.Pos,
+				priority:       dir.Priority,
 				IsTemplateFile: isTemplateFile,
 			})
 		}
 
 		// theme-specific files
-		if theme != nil && len(dir.ThemeFiles) > 0 {
+		if s.theme != nil && len(dir.ThemeFiles) > 0 {
 			for _, tf := range dir.ThemeFiles {
 				// use theme-specific source
-				src := tf.Sources[theme.Name]
+				src := tf.Sources[s.theme.Name]
 				if src == "" { // fallback to color scheme
-					src = tf.Sources[theme.ColorScheme]
+					src = tf.Sources[s.theme.ColorScheme]
 				}
 				if src == "" { // fallback to first source
-					for _, s := range tf.Sources {
-						src = s
+					for _, v := range tf.Sources {
+						src = v
 						break
 					}
 				}
 
 				// skip if no source
 				if src == "" {
+					filesToProcess = append(filesToProcess, File{
+						Target:   util.ExpandPathVars(tf.Target, s.home, s.vars),
+						Dir:      dir.Path,
+						pos:      dir.Pos,
+						priority: dir.Priority,
+						Reason:   "no source for theme",
+					})
 					continue
 				}
 
@@ -177,138 +281,153 @@ func Install(dir string, mode string, dryRun bool, extraContext map[string]inter
 					isTemplateFile = true
 				}
 
-				// resolve full path if not absolute
-				src = util.ResolvePathRelative(src, fullPath)
+				// resolve full path if not absolute, sources are on the real filesystem so ~ is the real home
+				src = util.ExpandPathRelativeVars(src, fullPath, "", s.vars)
+
+				// skip if the rules of the theme file do not match
+				reason := ""
+				match, err := s.matchRules(tf.Rules, fullPath, src)
+				if err != nil {
+					return nil, err
+				}
+				if !match {
+					reason = "rule mismatch"
+				}
 
 				// append to files
 				filesToProcess = append(filesToProcess, File{
 					Source:         src,
-					Target:         util.ResolvePath(tf.Target),
+					Target:         util.ExpandPathVars(tf.Target, s.home, s.vars),
+					Dir:            dir.Path,
+					pos:            dir.Pos,
+					priority:       dir.Priority,
 					IsTemplateFile: isTemplateFile,
+					Reason:         reason,
 				})
 			}
 		}
 
 		// determine directory mode (dir config > global flag, template always wins)
-		dirMode := mode
+		dirMode := s.mode
 		if dir.Mode != "" {
 			dirMode = dir.Mode
 		}
 
+		// determine conflict policy (file config > dir config > global flag)
+		dirConflict := s.conflict
+		if dir.Conflict != "" {
+			dirConflict = dir.Conflict
+		}
+
 		// process files
 		for _, f := range filesToProcess {
-			// skip if conditions do not match
-			match := config.EvaluateRulesWithContext(ruleCtx, dir.Rules, f.Source)
-			slog.Debug("processing file", "dir", f.Source, "target", f.Target, "condition-result", match)
-			if !match {
-				continue
+			// skip if excluded or file rules do not match
+			excluded := excludes.Match(f.Source)
+			match, err := s.rules.Match(dir.FileRules, f.Source)
+			if err != nil {
+				return nil, err
 			}
+			slog.Debug("processing file", "dir", f.Source, "target", f.Target, "condition-result", match, "excluded", excluded)
 
 			// determine mode (template > dir config > global flag)
-			fileMode := dirMode
+			f.Mode = dirMode
 			if f.IsTemplateFile {
-				fileMode = "template"
+				f.Mode = "template"
 			}
+			f.Conflict = dirConflict
 
-			// copy or link file
-			if linkErr := util.LinkFile(f.Source, f.Target, dryRun, fileMode, properties); linkErr != nil {
-				slog.Error("failed to link file", "source", f.Source, "target", f.Target, "err", linkErr)
-				os.Exit(1)
+			if excluded && f.Reason == "" {
+				f.Reason = "excluded"
+			}
+			if !match && f.Reason == "" {
+				f.Reason = "rule mismatch"
 			}
-			slog.Debug("process file", "source", f.Source, "target", f.Target, "mode", fileMode)
 
-			// state
-			state.ManagedFiles = append(state.ManagedFiles, f.Target)
+			result = append(result, f)
 		}
 
 		// link files with fallback paths (run after regular files so symlinks from this dir exist)
 		for _, fm := range dir.LinkFiles {
-			linkTarget := util.ResolvePathRelative(fm.Target, targetPath)
+			linkTarget := util.ExpandPathRelativeVars(fm.Target, targetPath, s.home, s.vars)
 
-			// find first source path that exists
+			// find first source path that exists, sources are on the real filesystem so ~ is the real home
 			sourcePath := ""
 			for _, p := range fm.Paths {
-				fp := util.ResolvePathRelative(p, fullPath)
+				fp := util.ExpandPathRelativeVars(p, fullPath, "", s.vars)
 				if _, err := os.Stat(fp); !os.IsNotExist(err) {
 					sourcePath = fp
 					break
 				}
 			}
-			if sourcePath == "" {
-				slog.Warn("no source file found for mapping, skipping", "target", linkTarget, "paths", fm.Paths)
-				continue
-			}
 
 			// determine mode (file config > dir config > global flag)
 			fileMode := dirMode
 			if fm.Mode != "" {
 				fileMode = fm.Mode
 			}
-
-			// copy or link file
-			if linkErr := util.LinkFile(sourcePath, linkTarget, dryRun, fileMode, properties); linkErr != nil {
-				slog.Error("failed to link file", "source", sourcePath, "target", linkTarget, "err", linkErr)
-				os.Exit(1)
+			fileConflict := dirConflict
+			if fm.Conflict != "" {
+				fileConflict = fm.Conflict
 			}
-			slog.Debug("process file mapping", "source", sourcePath, "target", linkTarget, "mode", fileMode)
-
-			// state
-			state.ManagedFiles = append(state.ManagedFiles, linkTarget)
-		}
-	}
-
-	// persist state (in case any of the commands query the state)
-	if saveErr := config.SaveState(stateFile, state); saveErr != nil {
-		slog.Error("failed to save state", "err", saveErr)
-		os.Exit(1)
-	}
-
-	// theme activation
-	if theme != nil && !dryRun {
-		if err := activateTheme(theme, conf.Commands, originalThemeName); err != nil {
-			slog.Error("failed to activate theme", "theme", themeName, "err", err)
-			os.Exit(1)
-		}
-	}
-
-	return nil
-}
 
-// activateTheme executes the theme activation commands, if available
-func activateTheme(theme *config.ThemeConfig, activationCommands []config.ThemeCommand, originalThemeName string) error {
-	for _, cmd := range append(activationCommands, theme.Commands...) {
-		slog.Debug("executing theme command", "command", cmd.Command)
-
-		if cmd.Condition != "" {
-			match, err := expr.EvalBooleanExpression(cmd.Condition, map[string]interface{}{
-				"env": os.Environ(),
-			})
+			// skip if the rules of the link file do not match
+			match, err := s.matchRules(fm.Rules, fullPath, sourcePath)
 			if err != nil {
-				slog.Warn("failed to evaluate theme activation command condition", "condition", cmd.Condition, "err", err)
+				return nil, err
+			}
+			if !match {
+				result = append(result, File{
+					Source:   sourcePath,
+					Target:   linkTarget,
+					Mode:     fileMode,
+					Dir:      dir.Path,
+					pos:      dir.Pos,
+					priority: dir.Priority,
+					Reason:   "rule mismatch",
+				})
 				continue
 			}
 
-			if !match {
+			if sourcePath == "" {
+				slog.Warn("no source file found for mapping, skipping", "target", linkTarget, "paths", fm.Paths)
+				result = append(result, File{
+					Target:   linkTarget,
+					Mode:     fileMode,
+					Dir:      dir.Path,
+					pos:      dir.Pos,
+					priority: dir.Priority,
+					Reason:   "no source file found",
+				})
 				continue
 			}
-		}
-		if cmd.OnChange && originalThemeName == theme.Name {
-			slog.Debug("command not executed, theme did not change", "command", cmd.Command)
-			continue
-		}
 
-		if err := util.RunCommand(cmd.Command); err != nil {
-			slog.Warn("failed to execute theme activation command", "command", cmd.Command, "err", err)
+			result = append(result, File{
+				Source:   sourcePath,
+				Target:   linkTarget,
+				Mode:     fileMode,
+				Dir:      dir.Path,
+				pos:      dir.Pos,
+				priority: dir.Priority,
+				Conflict: fileConflict,
+			})
 		}
 	}
 
-	return nil
+	return resolveCollisions(result)
 }
 
-func calculateFullPath(source string, path string) string {
-	fullPath := path
-	if !filepath.IsAbs(path) && path != "" && path[0] != filepath.Separator {
-		fullPath = filepath.Join(source, path)
+// matchRules evaluates the rules of a theme or link file, excludes are relative to the directory source
+func (s *session) matchRules(conditions []config.Rules, dirSource string, sourceFile string) (bool, error) {
+	if len(conditions) == 0 {
+		return true, nil
 	}
-	return fullPath
+
+	excludes, err := config.NewExcludes(conditions, dirSource)
+	if err != nil {
+		return false, err
+	}
+	if excludes.Match(sourceFile) {
+		return false, nil
+	}
+	return s.rules.Match(conditions, sourceFile)
 }
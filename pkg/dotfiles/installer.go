@@ -0,0 +1,270 @@
+package dotfiles
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+)
+
+// Options configures an Installer
+type Options struct {
+	Source      string                 // dotfiles source directory, defaults to the source of the last install
+	Mode        string                 // copy or symlink, defaults to the mode of the last install or copy
+	Theme       string                 // theme to install, DOTFILE_THEME takes precedence, defaults to the theme of the last install or the profile theme
+	Profile     string                 // profile to install, defaults to the profile of the last install
+	Only        []string               // only install directories with one of these names, paths or tags
+	Skip        []string               // skip directories with one of these names, paths or tags
+	Context     map[string]interface{} // additional values for rule evaluation and templates
+	Conflict    string                 // policy for existing unmanaged targets, defaults to skip
+	DryRun      bool                   // only write the plan to Output
+	Diff        bool                   // write unified diffs of pending changes to Output
+	Format      string                 // plan output format for dry runs (text, json)
+	Output      io.Writer              // receives plan, diffs, prompts and the summary, defaults to io.Discard
+	Input       io.Reader              // answers for the prompt conflict policy, prompts are skipped if it is not a terminal
+	Root        string                 // install below this directory instead of /, theme commands are not executed
+	Home        string                 // home directory used for ~ and $HOME in targets, templates and rules, defaults to $HOME
+	FS          util.FS                // filesystem for targets and state, takes precedence over Root
+	UnknownKeys string                 // handling of unknown configuration keys (error, warn), defaults to error
+}
+
+// Installer installs dotfiles according to the options, it never exits the process
+type Installer struct {
+	opts Options
+}
+
+// Result reports the outcome of an install
+type Result struct {
+	Plan       *Plan              `json:"plan"`
+	DryRun     bool               `json:"dry_run"`
+	Counts     map[ActionType]int `json:"counts"`
+	Conflicts  []Action           `json:"conflicts,omitempty"` // unmanaged targets and the applied conflict policy
+	Generation int                `json:"generation,omitempty"`
+}
+
+func NewInstaller(opts Options) *Installer {
+	if opts.Output == nil {
+		opts.Output = io.Discard
+	}
+	return &Installer{opts: opts}
+}
+
+// Store returns the state store on the filesystem selected by the options
+func (o Options) Store() *config.Store {
+	return config.NewStore(o.fs(), config.StateFileFor(o.Home))
+}
+
+// home returns the home directory used for ~ and $HOME (option > $HOME)
+func (o Options) home() string {
+	if o.Home != "" {
+		return o.Home
+	}
+	return os.Getenv("HOME")
+}
+
+// validate checks the mode and conflict policy before the state or configuration is read
+func (o Options) validate() error {
+	if o.Mode != "" && !slices.Contains(config.Modes, o.Mode) {
+		return fmt.Errorf("invalid mode %q (valid values: %s)", o.Mode, strings.Join(config.Modes, ", "))
+	}
+	if o.Conflict != "" && !slices.Contains(config.ConflictPolicies, o.Conflict) {
+		return fmt.Errorf("invalid conflict policy %q (valid values: %s)", o.Conflict, strings.Join(config.ConflictPolicies, ", "))
+	}
+	return nil
+}
+
+// fs returns the filesystem for targets and state
+func (o Options) fs() util.FS {
+	if o.FS != nil {
+		return o.FS
+	}
+	return util.NewFS(o.Root)
+}
+
+// Install applies the configuration, or only reports the plan for dry runs
+func (i *Installer) Install() (*Result, error) {
+	s, err := newSession(i.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// information
+	slog.Info("installing dotfiles", "dry-run", i.opts.DryRun, "mode", s.mode, "source", s.source)
+
+	// plan
+	plan, err := s.plan()
+	if err != nil {
+		return nil, err
+	}
+
+	// pending changes
+	if i.opts.Diff {
+		diff, err := s.diff(plan)
+		if err != nil {
+			return nil, err
+		}
+		_, _ = io.WriteString(i.opts.Output, diff)
+	}
+
+	// dry run only prints the plan
+	if i.opts.DryRun {
+		if i.opts.Format == "json" {
+			if err := plan.PrintJSON(i.opts.Output); err != nil {
+				return nil, err
+			}
+		} else {
+			plan.Print(i.opts.Output)
+		}
+		return newResult(plan, true, 0), nil
+	}
+
+	// conflicts are resolved before any change is made
+	if err := resolveConflicts(plan, i.opts.Input, i.opts.Output); err != nil {
+		return nil, err
+	}
+
+	if err := s.apply(plan); err != nil {
+		return nil, err
+	}
+	plan.PrintSummary(i.opts.Output)
+
+	return newResult(plan, false, s.state.Generation), nil
+}
+
+// Plan returns the actions an install would perform without changing anything
+func (i *Installer) Plan() (*Plan, error) {
+	s, err := newSession(i.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.plan()
+}
+
+// Diff renders unified diffs between the current targets and what install would write
+func (i *Installer) Diff() (string, error) {
+	s, err := newSession(i.opts)
+	if err != nil {
+		return "", err
+	}
+
+	plan, err := s.plan()
+	if err != nil {
+		return "", err
+	}
+
+	return s.diff(plan)
+}
+
+// Status compares all managed targets and the files the configuration would install with the current disk state
+func (i *Installer) Status() ([]StatusEntry, error) {
+	s, err := newSession(i.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.status()
+}
+
+// Validate checks the configuration and reports all problems with their position, it never changes any file
+func (i *Installer) Validate() ([]config.Problem, error) {
+	// source dir and profile (option or from state)
+	store := i.opts.Store()
+	state, err := store.LoadState()
+	if err != nil {
+		return nil, &StateError{File: store.StateFile, Err: err}
+	}
+	source := i.opts.Source
+	if source == "" {
+		source = state.Source
+	}
+	if source == "" {
+		return nil, ErrNoSource
+	}
+
+	// rules are evaluated with the context of the selected profile and theme, if the config can be loaded
+	var problems []config.Problem
+	file := filepath.Join(source, "dotfiles.yaml")
+	conf, _ := config.LoadWithOptions(file, config.LoadOptions{UnknownKeys: i.opts.UnknownKeys})
+	var profile *config.Profile
+	var theme *config.ThemeConfig
+	themeName := ""
+	if conf != nil {
+		profile, _ = selectProfile(conf, i.opts.Profile, state.Profile)
+		themeName = selectTheme(i.opts, profile, state.Profile, state.Theme)
+		theme = conf.GetTheme(themeName)
+	}
+	ruleCtx, values, err := ruleContext(i.opts, conf, profile, themeName)
+	if err != nil {
+		problems = append(problems, config.Problem{Position: config.Position{File: file}, Severity: config.SeverityError, Message: err.Error()})
+		ruleCtx, values, _ = ruleContext(i.opts, nil, profile, themeName)
+	}
+	vars := stringValues(values)
+
+	// syntax, keys, values and sources of all config files, sources are resolved like in install
+	ruleOpts := config.RuleOptions{FS: i.opts.fs()}
+	validateOpts := config.ValidateOptions{Rules: ruleOpts, Vars: vars}
+	problems = append(problems, config.Validate(file, source, ruleCtx, validateOpts, config.LoadOptions{UnknownKeys: i.opts.UnknownKeys})...)
+	if config.HasErrors(problems) || conf == nil {
+		return problems, nil
+	}
+
+	// targets provided by more than one file with the same priority, the files are resolved without reading the state again or writing anything
+	rules, err := config.NewRuleEngineWithOptions(ruleCtx, ruleOpts)
+	if err != nil {
+		return problems, &ConfigError{File: file, Err: err}
+	}
+	s := &session{
+		fs:        i.opts.fs(),
+		home:      i.opts.home(),
+		vars:      vars,
+		source:    source,
+		mode:      "copy",
+		conflict:  config.ConflictSkip,
+		conf:      conf,
+		profile:   profile,
+		themeName: themeName,
+		theme:     theme,
+		ruleCtx:   ruleCtx,
+		rules:     rules,
+		selection: Selection{Only: i.opts.Only, Skip: i.opts.Skip},
+	}
+	var collisionErr *CollisionError
+	if _, err := s.files(); errors.As(err, &collisionErr) {
+		for _, c := range collisionErr.Collisions {
+			message := fmt.Sprintf("target %s is also provided by %s (%s) with the same priority", c.Target, c.Sources[0], c.Positions[0])
+			if c.Nested != "" {
+				message = fmt.Sprintf("target %s is inside target %s provided by %s (%s) with the same priority", c.Nested, c.Target, c.Sources[0], c.Positions[0])
+			}
+			problems = append(problems, config.Problem{Position: c.Positions[1], Severity: config.SeverityError, Message: message})
+		}
+	} else if err != nil {
+		return problems, err
+	}
+
+	return problems, nil
+}
+
+func newResult(plan *Plan, dryRun bool, generation int) *Result {
+	result := &Result{
+		Plan:       plan,
+		DryRun:     dryRun,
+		Counts:     make(map[ActionType]int),
+		Generation: generation,
+	}
+	for _, a := range plan.Actions {
+		result.Counts[a.Type]++
+		if a.Conflict != "" {
+			result.Conflicts = append(result.Conflicts, a)
+		}
+	}
+
+	return result
+}
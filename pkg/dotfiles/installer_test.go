@@ -0,0 +1,367 @@
+package dotfiles
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+)
+
+const testHome = "/home/user"
+
+const testConfig = `
+directories:
+  - path: app
+    target: $HOME/.config/app
+`
+
+// newTestInstaller writes the config and source files to a temporary directory and installs to a MemFS
+func newTestInstaller(t *testing.T, files map[string]string) (Options, *util.MemFS) {
+	t.Helper()
+	t.Setenv("DOTFILE_STATE_FILE", "")
+	t.Setenv("DOTFILE_THEME", "")
+
+	source := t.TempDir()
+	files["dotfiles.yaml"] = testConfig
+	for name, content := range files {
+		writeTestFile(t, filepath.Join(source, name), content)
+	}
+
+	fsys := util.NewMemFS()
+	return Options{Source: source, Home: testHome, FS: fsys}, fsys
+}
+
+func writeTestFile(t *testing.T, file string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestTarget(t *testing.T, fsys util.FS, target string) string {
+	t.Helper()
+	content, err := fsys.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func install(t *testing.T, opts Options) *Result {
+	t.Helper()
+	result, err := NewInstaller(opts).Install()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestInstallCopiesAndSymlinks(t *testing.T) {
+	opts, fsys := newTestInstaller(t, map[string]string{"app/config.toml": "a = 1\n"})
+	target := filepath.Join(testHome, ".config/app/config.toml")
+
+	result := install(t, opts)
+	if result.Counts[ActionCreate] != 1 {
+		t.Errorf("expected 1 create, got %v", result.Counts)
+	}
+	if got := readTestTarget(t, fsys, target); got != "a = 1\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+
+	// a second install keeps the target
+	if result := install(t, opts); result.Counts[ActionKeep] != 1 {
+		t.Errorf("expected 1 keep, got %v", result.Counts)
+	}
+
+	// switching the mode replaces the copy with a symlink
+	opts.Mode = "symlink"
+	install(t, opts)
+	link, err := fsys.Readlink(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != filepath.Join(opts.Source, "app/config.toml") {
+		t.Errorf("unexpected symlink %s", link)
+	}
+}
+
+func TestInstallDryRunChangesNothing(t *testing.T) {
+	opts, fsys := newTestInstaller(t, map[string]string{"app/config.toml": "a = 1\n"})
+	opts.DryRun = true
+
+	result := install(t, opts)
+	if !result.DryRun || result.Counts[ActionCreate] != 1 {
+		t.Errorf("expected a dry run with 1 create, got %v", result.Counts)
+	}
+	if _, err := fsys.Lstat(filepath.Join(testHome, ".config/app/config.toml")); err == nil {
+		t.Error("dry run created the target")
+	}
+}
+
+func TestInstallConflicts(t *testing.T) {
+	target := filepath.Join(testHome, ".config/app/config.toml")
+	tests := []struct {
+		policy  string
+		content string
+		backup  bool
+		err     bool
+	}{
+		{policy: config.ConflictSkip, content: "unmanaged\n"},
+		{policy: config.ConflictOverwrite, content: "a = 1\n", backup: true},
+		{policy: config.ConflictBackup, content: "a = 1\n", backup: true},
+		{policy: config.ConflictFail, content: "unmanaged\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			opts, fsys := newTestInstaller(t, map[string]string{"app/config.toml": "a = 1\n"})
+			opts.Conflict = tt.policy
+			if err := util.CreateParentDirectory(fsys, target); err != nil {
+				t.Fatal(err)
+			}
+			if err := fsys.WriteFile(target, []byte("unmanaged\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := NewInstaller(opts).Install()
+			var conflictErr *ConflictError
+			if tt.err != errors.As(err, &conflictErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := readTestTarget(t, fsys, target); got != tt.content {
+				t.Errorf("expected %q, got %q", tt.content, got)
+			}
+
+			state, err := opts.Store().LoadState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			backups := state.GetBackups(target)
+			if tt.backup != (len(backups) == 1) {
+				t.Fatalf("unexpected backups %v", backups)
+			}
+			if tt.backup {
+				if got := readTestTarget(t, fsys, backups[0].Path); got != "unmanaged\n" {
+					t.Errorf("unexpected backup content %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestInstallLocallyModifiedTarget(t *testing.T) {
+	opts, fsys := newTestInstaller(t, map[string]string{"app/config.toml": "a = 1\n"})
+	target := filepath.Join(testHome, ".config/app/config.toml")
+	install(t, opts)
+
+	// the default policy keeps local edits even if the source changed
+	writeTestFile(t, filepath.Join(opts.Source, "app/config.toml"), "a = 2\n")
+	if err := fsys.WriteFile(target, []byte("edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result := install(t, opts)
+	if len(result.Conflicts) != 1 || result.Conflicts[0].Target != target {
+		t.Errorf("expected the edited target as conflict, got %v", result.Conflicts)
+	}
+	if got := readTestTarget(t, fsys, target); got != "edited\n" {
+		t.Errorf("local edit was overwritten: %q", got)
+	}
+}
+
+func TestInstallBacksUpLocallyModifiedStaleTarget(t *testing.T) {
+	opts, fsys := newTestInstaller(t, map[string]string{"app/a.toml": "a\n", "app/b.toml": "b\n"})
+	edited := filepath.Join(testHome, ".config/app/a.toml")
+	unchanged := filepath.Join(testHome, ".config/app/b.toml")
+	install(t, opts)
+
+	// both files leave the configuration, only the edit is kept
+	if err := os.RemoveAll(filepath.Join(opts.Source, "app")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFile(edited, []byte("edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result := install(t, opts)
+	if result.Counts[ActionDelete] != 2 || len(result.Conflicts) != 1 || result.Conflicts[0].Target != edited {
+		t.Errorf("expected 2 deletes and the edited target as conflict, got %v %v", result.Counts, result.Conflicts)
+	}
+	for _, target := range []string{edited, unchanged} {
+		if _, err := fsys.Lstat(target); err == nil {
+			t.Errorf("%s was not removed", target)
+		}
+	}
+
+	state, err := opts.Store().LoadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups := state.GetBackups(edited)
+	if len(backups) != 1 || len(state.Backups) != 1 {
+		t.Fatalf("expected a backup of the edited target only, got %v", state.Backups)
+	}
+	if got := readTestTarget(t, fsys, backups[0].Path); got != "edited\n" {
+		t.Errorf("unexpected backup content %q", got)
+	}
+}
+
+func TestInstallSelectsLegacyRecordsByTarget(t *testing.T) {
+	opts, _ := newTestInstaller(t, map[string]string{"app/config.toml": "a = 1\n"})
+	opts.Only = []string{"app"}
+	install(t, opts)
+
+	// records migrated from the first state version have no directory
+	store := opts.Store()
+	state, err := store.LoadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range state.ManagedFiles {
+		state.ManagedFiles[i].Dir = ""
+	}
+	if err := store.SaveState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	install(t, opts)
+	state, err = store.LoadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.ManagedFiles) != 1 || state.ManagedFiles[0].Dir != "app" {
+		t.Errorf("expected one record of the app directory, got %v", state.ManagedFiles)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	opts, fsys := newTestInstaller(t, map[string]string{"app/a.toml": "a\n", "app/b.toml": "b\n"})
+	install(t, opts)
+
+	writeTestFile(t, filepath.Join(opts.Source, "app/c.toml"), "c\n")
+	if err := fsys.WriteFile(filepath.Join(testHome, ".config/app/a.toml"), []byte("edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Remove(filepath.Join(testHome, ".config/app/b.toml")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := NewInstaller(opts).Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]FileStatus)
+	for _, e := range entries {
+		statuses[filepath.Base(e.Target)] = e.Status
+	}
+	expected := map[string]FileStatus{"a.toml": StatusModified, "b.toml": StatusMissing, "c.toml": StatusNew}
+	for name, status := range expected {
+		if statuses[name] != status {
+			t.Errorf("expected %s to be %s, got %s", name, status, statuses[name])
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	opts, _ := newTestInstaller(t, map[string]string{"app/config.toml": "a = 1\n"})
+	install(t, opts)
+
+	writeTestFile(t, filepath.Join(opts.Source, "app/config.toml"), "a = 2\n")
+	diff, err := NewInstaller(opts).Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "-a = 1\n") || !strings.Contains(diff, "+a = 2\n") {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	opts, fsys := newTestInstaller(t, map[string]string{"app/config.toml": "a = 1\n"})
+	target := filepath.Join(testHome, ".config/app/config.toml")
+	added := filepath.Join(testHome, ".config/app/added.toml")
+	install(t, opts)
+
+	writeTestFile(t, filepath.Join(opts.Source, "app/config.toml"), "a = 2\n")
+	writeTestFile(t, filepath.Join(opts.Source, "app/added.toml"), "added\n")
+	if result := install(t, opts); result.Generation != 2 {
+		t.Fatalf("expected generation 2, got %d", result.Generation)
+	}
+
+	g, err := Rollback(opts.Store(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.ID != 1 {
+		t.Errorf("expected generation 1, got %d", g.ID)
+	}
+	if got := readTestTarget(t, fsys, target); got != "a = 1\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if _, err := fsys.Lstat(added); err == nil {
+		t.Error("file of the newer generation was not removed")
+	}
+}
+
+func TestRollbackBacksUpLocallyModifiedTarget(t *testing.T) {
+	opts, fsys := newTestInstaller(t, map[string]string{"app/config.toml": "a = 1\n"})
+	target := filepath.Join(testHome, ".config/app/config.toml")
+	install(t, opts)
+	writeTestFile(t, filepath.Join(opts.Source, "app/config.toml"), "a = 2\n")
+	install(t, opts)
+
+	if err := fsys.WriteFile(target, []byte("edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Rollback(opts.Store(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestTarget(t, fsys, target); got != "a = 1\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+
+	state, err := opts.Store().LoadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups := state.GetBackups(target)
+	if len(backups) != 1 {
+		t.Fatalf("expected a backup of the edited target, got %v", state.Backups)
+	}
+	if got := readTestTarget(t, fsys, backups[0].Path); got != "edited\n" {
+		t.Errorf("unexpected backup content %q", got)
+	}
+}
+
+func TestValidateChangesNothing(t *testing.T) {
+	opts, fsys := newTestInstaller(t, map[string]string{"app/config.toml": "a = 1\n"})
+
+	problems, err := NewInstaller(opts).Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+	if _, err := fsys.Lstat(testHome); err == nil {
+		t.Error("validate created the state directory")
+	}
+}
+
+func TestInstallRejectsInvalidOptions(t *testing.T) {
+	for _, opts := range []Options{{Mode: "hardlink"}, {Conflict: "merge"}} {
+		base, fsys := newTestInstaller(t, map[string]string{"app/config.toml": "a = 1\n"})
+		opts.Source, opts.Home, opts.FS = base.Source, base.Home, base.FS
+
+		if _, err := NewInstaller(opts).Install(); err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("expected an invalid option error, got %v", err)
+		}
+		if _, err := fsys.Lstat(testHome); err == nil {
+			t.Error("invalid options changed the filesystem")
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package dotfiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+)
+
+type ActionType string
+
+const (
+	ActionCreate     ActionType = "create"      // copy or render a new target
+	ActionSymlink    ActionType = "symlink"     // create a new symlink
+	ActionUpdate     ActionType = "update"      // rewrite an outdated managed target
+	ActionReplace    ActionType = "replace"     // replace a target of a different kind or an unmanaged target, see conflict
+	ActionDelete     ActionType = "delete"      // remove a managed target that is no longer part of the configuration
+	ActionRunCommand ActionType = "run-command" // execute a theme activation command
+	ActionKeep       ActionType = "keep"        // managed target is up to date
+	ActionSkip       ActionType = "skip"        // file or command is not applied, see reason
+	ActionConflict   ActionType = "conflict"    // unmanaged target exists, resolved by the fail or prompt policy before applying
+)
+
+// Action is a single step of an install plan
+type Action struct {
+	Type     ActionType `json:"action"`
+	Target   string     `json:"target,omitempty"`
+	Source   string     `json:"source,omitempty"`
+	Mode     string     `json:"mode,omitempty"`
+	Dir      string     `json:"dir,omitempty"`
+	Command  string     `json:"command,omitempty"`
+	Conflict string     `json:"conflict,omitempty"` // conflict policy applied to an existing unmanaged or locally modified target
+	Modified bool       `json:"modified,omitempty"` // managed target was edited since install
+	Reason   string     `json:"reason,omitempty"`
+}
+
+func (a Action) file() File {
+	return File{Source: a.Source, Target: a.Target, Mode: a.Mode, Dir: a.Dir}
+}
+
+// Plan is the ordered list of actions an install performs
+type Plan struct {
+	Actions []Action `json:"actions"`
+}
+
+// Print writes the plan in human-readable form, up-to-date files are only counted
+func (p *Plan) Print(w io.Writer) {
+	kept := 0
+	tw := tabwriter.NewWriter(w, 1, 1, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ACTION\tMODE\tTARGET\tREASON")
+	for _, a := range p.Actions {
+		switch a.Type {
+		case ActionKeep:
+			kept++
+		case ActionRunCommand:
+			_, _ = fmt.Fprintf(tw, "%s\t\t%s\t%s\n", a.Type, a.Command, a.Reason)
+		case ActionSkip, ActionConflict:
+			subject := a.Target
+			if a.Command != "" {
+				subject = a.Command
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", a.Type, a.Mode, subject, a.Reason)
+		default:
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", a.Type, a.Mode, a.Target, a.Reason)
+		}
+	}
+	_ = tw.Flush()
+	if kept > 0 {
+		_, _ = fmt.Fprintf(w, "%d file(s) up to date\n", kept)
+	}
+}
+
+// PrintSummary writes the number of applied actions and how conflicting targets were handled
+func (p *Plan) PrintSummary(w io.Writer) {
+	counts := make(map[ActionType]int)
+	var conflicts []Action
+	for _, a := range p.Actions {
+		counts[a.Type]++
+		if a.Conflict != "" {
+			conflicts = append(conflicts, a)
+		}
+	}
+
+	_, _ = fmt.Fprintf(w, "%d created, %d symlinked, %d updated, %d replaced, %d deleted, %d unchanged, %d skipped\n",
+		counts[ActionCreate], counts[ActionSymlink], counts[ActionUpdate], counts[ActionReplace], counts[ActionDelete], counts[ActionKeep], counts[ActionSkip])
+	for _, a := range conflicts {
+		if a.Modified {
+			_, _ = fmt.Fprintf(w, "modified: %s (%s)\n", a.Target, a.Conflict)
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "conflict: %s (%s)\n", a.Target, a.Conflict)
+	}
+}
+
+// PrintJSON writes the plan as JSON
+func (p *Plan) PrintJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// DeletePlan creates a plan that removes all given managed files, edited files are moved to the backup store
+func DeletePlan(fsys util.FS, managedFiles []config.ManagedFile) *Plan {
+	plan := &Plan{Actions: []Action{}}
+	for _, mf := range managedFiles {
+		plan.Actions = append(plan.Actions, deleteAction(fsys, mf, "clean"))
+	}
+	return plan
+}
+
+// deleteAction removes a managed target, a target edited since install is moved to the backup store instead
+func deleteAction(fsys util.FS, mf config.ManagedFile, reason string) Action {
+	a := Action{Type: ActionDelete, Target: mf.Target, Source: mf.Source, Mode: mf.Mode, Dir: mf.Dir, Reason: reason}
+	if info, err := fsys.Lstat(mf.Target); err == nil && isModified(fsys, &mf, info) {
+		a.Modified = true
+		a.Conflict = config.ConflictBackup
+		a.Reason = reason + ", backup locally modified target"
+	}
+	return a
+}
+
+// plan determines the actions required to bring the targets in line with the configuration
+func (s *session) plan() (*Plan, error) {
+	files, err := s.collectFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Actions: []Action{}}
+	desired := make(map[string]bool, len(files))
+	for _, f := range files {
+		if f.Conflict != "" && !slices.Contains(config.ConflictPolicies, f.Conflict) {
+			return nil, fmt.Errorf("invalid conflict policy %q for %s (valid values: %s)", f.Conflict, f.Target, strings.Join(config.ConflictPolicies, ", "))
+		}
+		if f.Reason != "" {
+			plan.Actions = append(plan.Actions, Action{Type: ActionSkip, Target: f.Target, Source: f.Source, Mode: f.Mode, Dir: f.Dir, Reason: f.Reason})
+			continue
+		}
+		desired[f.Target] = true
+
+		plan.Actions = append(plan.Actions, fileAction(s.fs, f, s.state.GetManagedFile(f.Target), s.properties))
+	}
+
+	// remove managed files that are no longer part of the configuration, files outside the selection are kept
+	for _, mf := range s.managed {
+		if !desired[mf.Target] {
+			plan.Actions = append(plan.Actions, deleteAction(s.fs, mf, "no longer part of the configuration"))
+		}
+	}
+
+	// theme activation
+	plan.Actions = append(plan.Actions, s.commandActions()...)
+
+	return plan, nil
+}
+
+func fileAction(fsys util.FS, f File, managed *config.ManagedFile, properties map[string]string) Action {
+	a := Action{Target: f.Target, Source: f.Source, Mode: f.Mode, Dir: f.Dir}
+	createType := ActionCreate
+	if f.Mode == "symlink" {
+		createType = ActionSymlink
+	}
+
+	info, err := fsys.Lstat(f.Target)
+	if managed == nil {
+		if err == nil {
+			return conflictAction(a, f.Conflict)
+		}
+		a.Type = createType
+		a.Reason = "new file"
+		return a
+	}
+	if err != nil {
+		a.Type = createType
+		a.Reason = "target is missing"
+		return a
+	}
+	if util.IsUpToDate(fsys, f.Source, f.Target, f.Mode, properties) {
+		a.Type = ActionKeep
+		a.Reason = "up to date"
+		return a
+	}
+
+	// local edits are handled like unmanaged targets, so they are not overwritten silently
+	isSymlink := info.Mode()&os.ModeSymlink != 0
+	if isModified(fsys, managed, info) {
+		a.Modified = true
+		return conflictAction(a, f.Conflict)
+	}
+
+	switch {
+	case (f.Mode == "symlink") != isSymlink || (!isSymlink && !info.Mode().IsRegular()):
+		a.Type = ActionReplace
+		a.Reason = fmt.Sprintf("target kind changed to %s", f.Mode)
+	case f.Mode == "symlink":
+		a.Type = ActionUpdate
+		a.Reason = "symlink points elsewhere"
+	case f.Mode == "template":
+		a.Type = ActionUpdate
+		a.Reason = "rendered template changed"
+	default:
+		a.Type = ActionUpdate
+		a.Reason = "content changed"
+	}
+	return a
+}
+
+// isModified reports whether a managed target was edited since install, a copy with other content or a symlink replaced by a file
+func isModified(fsys util.FS, managed *config.ManagedFile, info os.FileInfo) bool {
+	if managed.Mode == "symlink" {
+		return info.Mode()&os.ModeSymlink == 0
+	}
+	if managed.Hash == "" || !info.Mode().IsRegular() {
+		return false
+	}
+	hash, err := util.HashFile(fsys, managed.Target)
+	return err == nil && hash != managed.Hash
+}
+
+// conflictAction applies the conflict policy to an existing target that is not managed or was modified since install
+func conflictAction(a Action, policy string) Action {
+	subject := "unmanaged target"
+	if a.Modified {
+		subject = "locally modified target"
+	}
+
+	a.Conflict = policy
+	switch policy {
+	case config.ConflictOverwrite:
+		a.Type = ActionReplace
+		a.Reason = "overwrite " + subject
+	case config.ConflictBackup:
+		a.Type = ActionReplace
+		a.Reason = "backup and replace " + subject
+	case config.ConflictFail, config.ConflictPrompt:
+		a.Type = ActionConflict
+		a.Reason = conflictReason(a)
+	default:
+		a.Type = ActionSkip
+		a.Reason = conflictReason(a)
+	}
+	return a
+}
+
+// conflictReason describes why the target conflicts
+func conflictReason(a Action) string {
+	if a.Modified {
+		return "target was edited since install"
+	}
+	return "target exists and is not managed"
+}
+
+// commandActions determines which theme activation commands will be executed
+func (s *session) commandActions() []Action {
+	if s.theme == nil {
+		return nil
+	}
+
+	var actions []Action
+	for _, cmd := range slices.Concat(s.conf.Commands, s.theme.Commands) {
+		a := Action{Type: ActionRunCommand, Command: cmd.Command, Reason: "theme activation"}
+
+		if cmd.Condition != "" {
+			match, err := s.rules.Eval(cmd.Condition, "")
+			if err != nil {
+				a.Type = ActionSkip
+				a.Reason = fmt.Sprintf("failed to evaluate condition: %s", err)
+			} else if !match {
+				a.Type = ActionSkip
+				a.Reason = "condition did not match"
+			}
+		}
+		if a.Type == ActionRunCommand && cmd.OnChange && s.originalThemeName == s.theme.Name {
+			a.Type = ActionSkip
+			a.Reason = "theme did not change"
+		}
+		if a.Type == ActionRunCommand && !s.runCommands {
+			a.Type = ActionSkip
+			a.Reason = "alternate root"
+		}
+
+		actions = append(actions, a)
+	}
+
+	return actions
+}
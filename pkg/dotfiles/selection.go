@@ -0,0 +1,112 @@
+package dotfiles
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+)
+
+// Selection limits a run to some directories, selectors match the name, path or a tag of a directory
+type Selection struct {
+	Only []string // only directories matching one of the selectors, all directories if empty
+	Skip []string // directories matching one of the selectors are skipped
+}
+
+// IsEmpty reports whether the selection contains all directories
+func (sel Selection) IsEmpty() bool {
+	return len(sel.Only) == 0 && len(sel.Skip) == 0
+}
+
+// Selects reports whether the directory is part of the selection
+func (sel Selection) Selects(d config.Dir) bool {
+	if len(sel.Only) > 0 && !slices.ContainsFunc(sel.Only, d.Matches) {
+		return false
+	}
+	return !slices.ContainsFunc(sel.Skip, d.Matches)
+}
+
+// ManagedFiles splits the managed files into the files of selected directories and all others.
+// Files of directories that are not part of the configuration are only selected if the selection is empty.
+// Home and vars expand the directory targets for records that are matched by target.
+func (sel Selection) ManagedFiles(dirs []config.Dir, managedFiles []config.ManagedFile, home string, vars map[string]string) (selected []config.ManagedFile, other []config.ManagedFile) {
+	if sel.IsEmpty() {
+		return managedFiles, nil
+	}
+
+	for _, mf := range managedFiles {
+		if sel.selectsManagedFile(dirs, mf, home, vars) {
+			selected = append(selected, mf)
+		} else {
+			other = append(other, mf)
+		}
+	}
+	return selected, other
+}
+
+// selectsManagedFile reports whether the managed file belongs to a selected directory.
+// Records without directory (migrated from state version 1) and records of a path shared by several directories are matched by target.
+func (sel Selection) selectsManagedFile(dirs []config.Dir, mf config.ManagedFile, home string, vars map[string]string) bool {
+	candidates := slices.DeleteFunc(slices.Clone(dirs), func(d config.Dir) bool {
+		return mf.Dir != "" && d.Path != mf.Dir
+	})
+	if mf.Dir != "" && len(candidates) == 1 {
+		return sel.Selects(candidates[0])
+	}
+
+	return slices.ContainsFunc(candidates, func(d config.Dir) bool {
+		return sel.Selects(d) && providesTarget(d, mf.Target, home, vars)
+	})
+}
+
+// providesTarget reports whether the target is inside the directory target or one of its theme or link file targets
+func providesTarget(d config.Dir, target string, home string, vars map[string]string) bool {
+	root := util.ExpandPathVars(d.Target, home, vars)
+	if root != "" && (target == root || strings.HasPrefix(target, root+string(filepath.Separator))) {
+		return true
+	}
+	for _, tf := range d.ThemeFiles {
+		if util.ExpandPathVars(tf.Target, home, vars) == target {
+			return true
+		}
+	}
+	for _, lf := range d.LinkFiles {
+		if util.ExpandPathRelativeVars(lf.Target, root, home, vars) == target {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectManagedFiles splits the managed files of the state into the files of the selected directories and all others.
+// The configuration of the last install is only loaded if the selection is not empty, home expands the directory targets.
+func SelectManagedFiles(state *config.DotfileState, sel Selection, home string) (selected []config.ManagedFile, other []config.ManagedFile, err error) {
+	if sel.IsEmpty() {
+		return state.ManagedFiles, nil, nil
+	}
+
+	file := filepath.Join(state.Source, "dotfiles.yaml")
+	conf, err := config.Load(file, true)
+	if err != nil {
+		return nil, nil, &ConfigError{File: file, Err: err}
+	}
+	profile, err := selectProfile(conf, "", state.Profile)
+	if err != nil {
+		return nil, nil, &ConfigError{File: file, Err: err}
+	}
+
+	selected, other = sel.ManagedFiles(profileDirs(conf, profile), state.ManagedFiles, home, nil)
+	return selected, other, nil
+}
+
+// profileDirs returns the directories selected by the profile, all directories if there is no profile
+func profileDirs(conf *config.DotfilesConfig, profile *config.Profile) []config.Dir {
+	if profile == nil {
+		return conf.Directories
+	}
+	return slices.DeleteFunc(slices.Clone(conf.Directories), func(d config.Dir) bool {
+		return !profile.Selects(d)
+	})
+}
@@ -0,0 +1,302 @@
+package dotfiles
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+	"github.com/iancoleman/strcase"
+)
+
+// session holds everything that is resolved once per run and shared by install, status and diff
+type session struct {
+	fs                util.FS
+	store             *config.Store
+	home              string
+	vars              map[string]string // variables and context values for target paths
+	runCommands       bool              // theme commands only run for installs to the real root
+	state             *config.DotfileState
+	source            string
+	mode              string
+	conflict          string
+	conf              *config.DotfilesConfig
+	profile           *config.Profile
+	selection         Selection
+	managed           []config.ManagedFile // managed files of the selected directories
+	unselected        []config.ManagedFile // managed files outside the selection, kept as they are
+	themeName         string
+	originalThemeName string
+	theme             *config.ThemeConfig
+	properties        map[string]string
+	ruleCtx           config.RuleContext
+	rules             *config.RuleEngine // compiled rules, shared by all files
+}
+
+func newSession(opts Options) (*session, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	// load state
+	store := opts.Store()
+	if err := util.CreateParentDirectory(store.FS, store.StateFile); err != nil {
+		return nil, &StateError{File: store.StateFile, Err: err}
+	}
+	state, err := store.LoadState()
+	if err != nil {
+		return nil, &StateError{File: store.StateFile, Err: err}
+	}
+
+	// source dir (option or from state)
+	source := opts.Source
+	if source == "" {
+		source = state.Source
+	}
+	if source == "" {
+		return nil, ErrNoSource
+	}
+	state.Source = source
+
+	// mode (option > persisted state > copy)
+	mode := opts.Mode
+	if mode == "" {
+		mode = state.Mode
+	}
+	if mode == "" {
+		mode = "copy"
+	}
+	state.Mode = mode
+
+	// conflict policy for existing unmanaged targets
+	conflict := opts.Conflict
+	if conflict == "" {
+		conflict = config.ConflictSkip
+	}
+
+	// load config
+	conf, err := config.LoadWithOptions(filepath.Join(source, "dotfiles.yaml"), config.LoadOptions{Require: true, UnknownKeys: opts.UnknownKeys})
+	if err != nil {
+		return nil, &ConfigError{File: filepath.Join(source, "dotfiles.yaml"), Err: err}
+	}
+
+	// profile (option > persisted state)
+	profile, err := selectProfile(conf, opts.Profile, state.Profile)
+	if err != nil {
+		return nil, &ConfigError{File: filepath.Join(source, "dotfiles.yaml"), Err: err}
+	}
+	previousProfile := state.Profile
+	state.Profile = ""
+	if profile != nil {
+		state.Profile = profile.Name
+		for _, selector := range profile.Directories {
+			if !slices.ContainsFunc(conf.Directories, func(d config.Dir) bool { return d.Matches(selector) }) {
+				slog.Warn("profile selects no directory", "profile", profile.Name, "selector", selector)
+			}
+		}
+	}
+
+	// theme
+	themeName := selectTheme(opts, profile, previousProfile, state.Theme)
+	originalThemeName := state.Theme
+	state.Theme = themeName
+	theme := conf.GetTheme(themeName)
+	state.ActiveTheme = theme
+
+	// home directory (option > $HOME)
+	home := opts.home()
+
+	// properties (built once, reused for all directories)
+	properties := map[string]string{
+		"Home":    home,
+		"User":    os.Getenv("USER"),
+		"Profile": state.Profile,
+	}
+	if theme != nil {
+		properties["Name"] = themeName
+		properties["ColorScheme"] = theme.ColorScheme
+		properties["WallpaperDir"] = theme.WallpaperDir
+		properties["FontFamily"] = theme.FontFamily
+		properties["FontSize"] = theme.FontSize
+		properties["GtkTheme"] = theme.GtkTheme
+		properties["IconTheme"] = theme.IconTheme
+		properties["CursorTheme"] = theme.CursorTheme
+		for k, v := range theme.Properties {
+			properties[strcase.ToCamel(k)] = v
+		}
+	}
+
+	// rule context and variables (built once, reused for all files)
+	ruleCtx, values, err := ruleContext(opts, conf, profile, themeName)
+	if err != nil {
+		return nil, &ConfigError{File: filepath.Join(source, "dotfiles.yaml"), Err: err}
+	}
+	vars := stringValues(values)
+	for k, v := range vars {
+		properties[strcase.ToCamel(k)] = v
+	}
+
+	// rules are compiled once, invalid rules of the selected directories fail before any file is processed
+	rules, err := config.NewRuleEngineWithOptions(ruleCtx, config.RuleOptions{FS: store.FS})
+	if err != nil {
+		return nil, &ConfigError{File: filepath.Join(source, "dotfiles.yaml"), Err: err}
+	}
+
+	_, isOS := store.FS.(util.OSFS)
+
+	s := &session{
+		fs:                store.FS,
+		store:             store,
+		home:              home,
+		vars:              vars,
+		runCommands:       isOS,
+		state:             state,
+		source:            source,
+		mode:              mode,
+		conflict:          conflict,
+		conf:              conf,
+		profile:           profile,
+		themeName:         themeName,
+		originalThemeName: originalThemeName,
+		theme:             theme,
+		properties:        properties,
+		ruleCtx:           ruleCtx,
+		rules:             rules,
+		selection:         Selection{Only: opts.Only, Skip: opts.Skip},
+	}
+
+	// selection (--only and --skip within the profile)
+	dirs := profileDirs(conf, profile)
+	if !s.selection.IsEmpty() && !slices.ContainsFunc(dirs, s.selection.Selects) {
+		slog.Warn("selection matches no directory", "only", opts.Only, "skip", opts.Skip)
+	}
+	s.managed, s.unselected = s.selection.ManagedFiles(dirs, state.ManagedFiles, home, vars)
+	if err := rules.CompileDirs(slices.DeleteFunc(slices.Clone(conf.Directories), func(d config.Dir) bool { return !s.selects(d) })); err != nil {
+		return nil, &ConfigError{File: filepath.Join(source, "dotfiles.yaml"), Err: err}
+	}
+
+	return s, nil
+}
+
+// selects reports whether the directory is part of the profile and the selection
+func (s *session) selects(d config.Dir) bool {
+	return (s.profile == nil || s.profile.Selects(d)) && s.selection.Selects(d)
+}
+
+// selectProfile returns the selected profile, or the profile of the last install if none is selected
+func selectProfile(conf *config.DotfilesConfig, name string, previous string) (*config.Profile, error) {
+	if name == "" {
+		name = previous
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	profile := conf.GetProfile(name)
+	if profile == nil {
+		return nil, fmt.Errorf("profile %s is not defined", name)
+	}
+	return profile, nil
+}
+
+// selectTheme returns the theme name (env > flag, and falls back to persisted state and the profile theme; flag is only used when env is unset).
+// A profile that is selected by flag or differs from the last install applies its theme instead of the persisted one.
+func selectTheme(opts Options, profile *config.Profile, previousProfile string, previousTheme string) string {
+	profileName := ""
+	if profile != nil {
+		profileName = profile.Name
+	}
+	profileFirst := opts.Profile != "" || profileName != previousProfile
+
+	themeName := os.Getenv("DOTFILE_THEME")
+	if themeName == "" {
+		themeName = opts.Theme
+	}
+	if themeName == "" && profile != nil && profileFirst {
+		themeName = profile.Theme
+	}
+	if themeName == "" {
+		themeName = previousTheme
+	}
+	if themeName == "" && profile != nil {
+		themeName = profile.Theme
+	}
+	return themeName
+}
+
+// stringValues converts variables and context values for target paths and templates, values of other types are omitted
+func stringValues(values map[string]interface{}) map[string]string {
+	vars := make(map[string]string, len(values))
+	for k, v := range values {
+		switch val := v.(type) {
+		case string:
+			vars[k] = val
+		case bool:
+			vars[k] = fmt.Sprintf("%t", val)
+		case int, int64:
+			vars[k] = fmt.Sprintf("%d", val)
+		case float64:
+			vars[k] = fmt.Sprintf("%v", val)
+		}
+	}
+	return vars
+}
+
+// contextValues returns the additional context values, the profile context is overridden by the options
+func contextValues(opts Options, profile *config.Profile) map[string]interface{} {
+	values := make(map[string]interface{})
+	if profile != nil {
+		maps.Copy(values, profile.Context)
+	}
+	maps.Copy(values, opts.Context)
+	return values
+}
+
+// ruleContext builds the rule context including the home override, the profile, the active theme, the variables and additional context values.
+// It also returns the variables and context values, context values take precedence over variables with the same name.
+func ruleContext(opts Options, conf *config.DotfilesConfig, profile *config.Profile, theme string) (config.RuleContext, map[string]interface{}, error) {
+	ruleCtx := config.BuildRuleContext()
+	if opts.Home != "" {
+		ruleCtx["home"] = opts.Home
+	}
+	if theme != "" {
+		ruleCtx["theme"] = theme
+	}
+	ruleCtx["profile"] = ""
+	if profile != nil {
+		ruleCtx["profile"] = profile.Name
+	}
+	context := contextValues(opts, profile)
+	maps.Copy(ruleCtx, context)
+
+	// variables can use the context values
+	values := make(map[string]interface{})
+	if conf != nil {
+		hostname, _ := ruleCtx["hostname"].(string)
+		variables, err := conf.ResolveVariables(ruleCtx, profile, hostname, config.RuleOptions{FS: opts.fs()})
+		if err != nil {
+			return nil, nil, err
+		}
+		values = variables
+	}
+	maps.Copy(values, context)
+	maps.Copy(ruleCtx, values)
+
+	return ruleCtx, values, nil
+}
+
+// files resolves all files the configuration would install, skipped files are omitted
+func (s *session) files() ([]File, error) {
+	files, err := s.collectFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(files, func(f File) bool {
+		return f.Reason != ""
+	}), nil
+}
@@ -0,0 +1,132 @@
+package dotfiles
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+)
+
+type FileStatus string
+
+const (
+	StatusOK             FileStatus = "ok"              // target matches the configuration
+	StatusNew            FileStatus = "new"             // source file is not installed yet
+	StatusConflict       FileStatus = "conflict"        // target exists but is not managed, install would skip it
+	StatusMissing        FileStatus = "missing"         // managed target was removed
+	StatusModified       FileStatus = "modified"        // managed copy was edited since install
+	StatusSymlinkChanged FileStatus = "symlink-changed" // managed symlink points elsewhere
+	StatusOutdated       FileStatus = "outdated"        // source or mode changed since install
+	StatusStaleTemplate  FileStatus = "stale-template"  // template renders differently, e.g. theme properties changed
+	StatusOrphaned       FileStatus = "orphaned"        // managed target is no longer part of the configuration
+)
+
+type StatusEntry struct {
+	Status FileStatus `json:"status"`
+	Target string     `json:"target"`
+	Source string     `json:"source,omitempty"`
+	Mode   string     `json:"mode,omitempty"`
+	Detail string     `json:"detail,omitempty"`
+}
+
+func (s *session) status() ([]StatusEntry, error) {
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []StatusEntry
+	desired := make(map[string]bool, len(files))
+	for _, f := range files {
+		if desired[f.Target] {
+			continue
+		}
+		desired[f.Target] = true
+
+		result = append(result, fileStatus(s.fs, f, s.state.GetManagedFile(f.Target), s.properties))
+	}
+
+	for _, mf := range s.managed {
+		if !desired[mf.Target] {
+			result = append(result, StatusEntry{Status: StatusOrphaned, Target: mf.Target, Source: mf.Source, Mode: mf.Mode, Detail: "no longer part of the configuration"})
+		}
+	}
+
+	return result, nil
+}
+
+func fileStatus(fsys util.FS, f File, managed *config.ManagedFile, properties map[string]string) StatusEntry {
+	entry := StatusEntry{Target: f.Target, Source: f.Source, Mode: f.Mode}
+
+	info, err := fsys.Lstat(f.Target)
+	if managed == nil {
+		switch {
+		case err != nil:
+			entry.Status = StatusNew
+		case util.IsUpToDate(fsys, f.Source, f.Target, f.Mode, properties):
+			entry.Status = StatusNew
+			entry.Detail = "target exists with identical content"
+		default:
+			entry.Status = StatusConflict
+			entry.Detail = "target exists and is not managed"
+		}
+		return entry
+	}
+	if err != nil {
+		entry.Status = StatusMissing
+		entry.Detail = "target does not exist"
+		return entry
+	}
+
+	isSymlink := info.Mode()&os.ModeSymlink != 0
+	if f.Mode == "symlink" {
+		entry.Status = StatusOK
+		if !isSymlink {
+			entry.Status = StatusModified
+			entry.Detail = "symlink was replaced by a regular file"
+		} else if link, _ := fsys.Readlink(f.Target); link != f.Source {
+			entry.Status = StatusSymlinkChanged
+			entry.Detail = fmt.Sprintf("points to %s", link)
+		}
+		return entry
+	}
+
+	if isSymlink || !info.Mode().IsRegular() {
+		entry.Status = StatusOutdated
+		entry.Detail = fmt.Sprintf("target is not a regular file, expected %s", f.Mode)
+		return entry
+	}
+	currentHash, err := util.HashFile(fsys, f.Target)
+	if err != nil {
+		entry.Status = StatusModified
+		entry.Detail = err.Error()
+		return entry
+	}
+	if managed.Hash != "" && managed.Hash != currentHash {
+		entry.Status = StatusModified
+		entry.Detail = "target was edited since install"
+		return entry
+	}
+
+	expected, err := util.ReadSource(f.Source, f.Mode, properties)
+	if err != nil {
+		entry.Status = StatusOutdated
+		entry.Detail = err.Error()
+		return entry
+	}
+	if util.HashBytes(expected) != currentHash {
+		entry.Status = StatusOutdated
+		entry.Detail = "source changed since install"
+		if f.Mode == "template" {
+			entry.Status = StatusStaleTemplate
+			entry.Detail = "rendered template changed since install"
+		} else if managed.Mode != f.Mode {
+			entry.Detail = fmt.Sprintf("mode changed from %s to %s", managed.Mode, f.Mode)
+		}
+		return entry
+	}
+
+	entry.Status = StatusOK
+	return entry
+}
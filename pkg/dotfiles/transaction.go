@@ -0,0 +1,161 @@
+package dotfiles
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/util"
+)
+
+// transaction stages all writes before touching any target and keeps an undo journal,
+// so a failed install restores the previous files and the state file stays consistent with disk.
+type transaction struct {
+	fs          util.FS
+	staged      map[string]string // target -> staged file next to the target
+	createdDirs []string          // directories created while staging
+	aside       []string          // previous targets moved aside, removed on commit
+	undo        []func() error
+}
+
+func newTransaction(fsys util.FS) *transaction {
+	return &transaction{fs: fsys, staged: make(map[string]string)}
+}
+
+// stage writes the new content of the target to a temporary file next to it
+func (t *transaction) stage(source string, target string, mode string, properties map[string]string) error {
+	t.createdDirs = append(t.createdDirs, missingDirs(t.fs, filepath.Dir(target))...)
+
+	staged, err := util.StageFile(t.fs, source, target, mode, properties)
+	if err != nil {
+		return fmt.Errorf("failed to stage %s: %w", target, err)
+	}
+	t.staged[target] = staged
+
+	return nil
+}
+
+// stageContent writes the content of the target to a temporary file next to it, the executable bit of the source is kept
+func (t *transaction) stageContent(target string, content []byte, source string) error {
+	t.createdDirs = append(t.createdDirs, missingDirs(t.fs, filepath.Dir(target))...)
+
+	if err := util.CreateParentDirectory(t.fs, target); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", target, err)
+	}
+	staged, err := util.TempName(t.fs, target, "dotfiles")
+	if err != nil {
+		return fmt.Errorf("failed to stage %s: %w", target, err)
+	}
+	if err := t.fs.WriteFile(staged, content, 0644); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", target, err)
+	}
+	t.staged[target] = staged
+	if err := util.EnsureExecutable(t.fs, source, staged); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", target, err)
+	}
+
+	return nil
+}
+
+// moveAside renames an existing target, it is restored on rollback and removed on commit
+func (t *transaction) moveAside(target string) error {
+	if _, err := t.fs.Lstat(target); os.IsNotExist(err) {
+		return nil
+	}
+
+	// unique name next to the target
+	aside, err := util.TempName(t.fs, target, "dotfiles-old")
+	if err != nil {
+		return fmt.Errorf("failed to move %s aside: %w", target, err)
+	}
+	if err := t.fs.Rename(target, aside); err != nil {
+		return fmt.Errorf("failed to move %s aside: %w", target, err)
+	}
+	t.aside = append(t.aside, aside)
+	t.undo = append(t.undo, func() error {
+		return t.fs.Rename(aside, target)
+	})
+
+	return nil
+}
+
+// backup moves an existing unmanaged target into the backup store
+func (t *transaction) backup(store *config.Store, state *config.DotfileState, target string) error {
+	backup, err := BackupFile(store, state, target)
+	if err != nil {
+		return err
+	}
+	slog.Info("moved existing file to backup", "target", target, "backup", backup.Path)
+	t.undo = append(t.undo, func() error {
+		return util.MoveFile(t.fs, backup.Path, target)
+	})
+
+	return nil
+}
+
+// place moves the staged file to the target
+func (t *transaction) place(target string) error {
+	staged, ok := t.staged[target]
+	if !ok {
+		return fmt.Errorf("no staged file for %s", target)
+	}
+
+	if err := t.fs.Rename(staged, target); err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", target, err)
+	}
+	delete(t.staged, target)
+	t.undo = append(t.undo, func() error {
+		return t.fs.Remove(target)
+	})
+
+	return nil
+}
+
+// commit removes the previous targets that were moved aside
+func (t *transaction) commit() {
+	for _, aside := range t.aside {
+		if err := t.fs.Remove(aside); err != nil {
+			slog.Debug("failed to remove previous file", "file", aside, "err", err)
+		}
+	}
+	t.aside = nil
+	t.undo = nil
+}
+
+// rollback restores all targets in reverse order and removes staged files and created directories
+func (t *transaction) rollback() error {
+	var errs []error
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		if err := t.undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, staged := range t.staged {
+		_ = t.fs.Remove(staged)
+	}
+	slices.SortFunc(t.createdDirs, func(a, b string) int {
+		return len(b) - len(a) // deepest first
+	})
+	for _, dir := range t.createdDirs {
+		_ = t.fs.Remove(dir) // only succeeds if empty
+	}
+	t.undo = nil
+
+	return errors.Join(errs...)
+}
+
+// missingDirs returns the directory and all of its parents that do not exist yet
+func missingDirs(fsys util.FS, dir string) []string {
+	var missing []string
+	for ; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, err := fsys.Stat(dir); err == nil {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	return missing
+}
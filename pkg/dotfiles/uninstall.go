@@ -3,29 +3,44 @@ package dotfiles
 import (
 	"log/slog"
 	"os"
+
+	"github.com/PhilippHeuer/dotfiles-cli/pkg/config"
 )
 
-// DeleteManagedFiles deletes all files listed in managedFiles.
+// DeleteManagedFiles deletes all files listed in managedFiles, files edited since install are moved to the backup store.
 // If dryRun is true, no files are deleted but those that would be deleted are returned.
 // It returns a slice of files that could not be deleted.
-func DeleteManagedFiles(managedFiles []string, dryRun bool) []string {
-	var failedToDelete []string
+func DeleteManagedFiles(store *config.Store, state *config.DotfileState, managedFiles []config.ManagedFile, dryRun bool) []config.ManagedFile {
+	fsys := store.FS
+	var failedToDelete []config.ManagedFile
 
-	for _, file := range managedFiles {
+	for _, managedFile := range managedFiles {
+		file := managedFile.Target
 		slog.Debug("removing file", "file", file)
 
 		if dryRun {
-			failedToDelete = append(failedToDelete, file)
+			failedToDelete = append(failedToDelete, managedFile)
 			continue
 		}
 
-		if _, err := os.Stat(file); os.IsNotExist(err) {
+		info, err := fsys.Lstat(file)
+		if os.IsNotExist(err) {
 			slog.Debug("file does not exist, already deleted", "file", file)
 			continue
 		}
+		if err == nil && isModified(fsys, &managedFile, info) {
+			backup, err := BackupFile(store, state, file)
+			if err != nil {
+				failedToDelete = append(failedToDelete, managedFile)
+				slog.Debug("failed to backup file", "file", file, "err", err)
+				continue
+			}
+			slog.Info("moved locally modified file to backup", "target", file, "backup", backup.Path)
+			continue
+		}
 
-		if err := os.Remove(file); err != nil {
-			failedToDelete = append(failedToDelete, file)
+		if err := fsys.Remove(file); err != nil {
+			failedToDelete = append(failedToDelete, managedFile)
 			slog.Debug("failed to remove file", "file", file, "err", err)
 		}
 	}
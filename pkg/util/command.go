@@ -3,6 +3,7 @@ package util
 import (
 	"os"
 	"os/exec"
+	"strings"
 )
 
 // RunCommand executes a given shell command and returns an error if the command fails.
@@ -16,3 +17,17 @@ func RunCommand(command string) error {
 
 	return cmd.Run()
 }
+
+// CommandOutput executes a given shell command and returns its output without surrounding whitespace
+func CommandOutput(command string) (string, error) {
+	command = ResolvePath(command) // support placeholders such as ~ and $HOME
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
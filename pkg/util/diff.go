@@ -0,0 +1,185 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContextLines = 3
+
+type diffOp struct {
+	kind byte // ' ' equal, '-' delete, '+' insert
+	line string
+}
+
+// UnifiedDiff returns a unified diff between two contents, or an empty string if both are equal.
+func UnifiedDiff(fromName string, toName string, from []byte, to []byte) string {
+	ops := diffLines(splitLines(string(from)), splitLines(string(to)))
+
+	// positions of each operation in the old and new content
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	var changes []int
+	for i, op := range ops {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if op.kind != '+' {
+			aPos[i+1]++
+		}
+		if op.kind != '-' {
+			bPos[i+1]++
+		}
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	// group changes into hunks with surrounding context
+	type hunk struct{ start, end int }
+	var hunks []hunk
+	for _, c := range changes {
+		start, end := max(c-diffContextLines, 0), min(c+diffContextLines+1, len(ops))
+		if len(hunks) > 0 && start <= hunks[len(hunks)-1].end {
+			hunks[len(hunks)-1].end = end
+			continue
+		}
+		hunks = append(hunks, hunk{start, end})
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", fromName, toName))
+	for _, h := range hunks {
+		aStart, aCount := aPos[h.start], aPos[h.end]-aPos[h.start]
+		bStart, bCount := bPos[h.start], bPos[h.end]-bPos[h.start]
+		if aCount > 0 {
+			aStart++
+		}
+		if bCount > 0 {
+			bStart++
+		}
+		sb.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount))
+
+		for _, op := range ops[h.start:h.end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+
+	return sb.String()
+}
+
+func splitLines(content string) []string {
+	lines := strings.SplitAfter(content, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes the shortest edit script between a and b using the linear-space variant of the Myers algorithm
+func diffLines(a []string, b []string) []diffOp {
+	return appendDiff(make([]diffOp, 0, len(a)+len(b)), a, b)
+}
+
+// appendDiff appends the edit script between a and b, it splits the inputs at the middle snake and recurses into both halves
+func appendDiff(ops []diffOp, a []string, b []string) []diffOp {
+	// common prefix and suffix
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	tail := a[len(a)-suffix:]
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	switch {
+	case len(a) == 0:
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+	case len(b) == 0:
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+	default:
+		// both sides differ at the start and the end, so each half contains at least one edit
+		x, y, u, v := middleSnake(a, b)
+		ops = appendDiff(ops, a[:x], b[:y])
+		for _, line := range a[x:u] {
+			ops = append(ops, diffOp{' ', line})
+		}
+		ops = appendDiff(ops, a[u:], b[v:])
+	}
+
+	for _, line := range tail {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// middleSnake searches the shortest edit script from both ends at once and returns the snake (x, y) to (u, v) where the searches meet
+func middleSnake(a []string, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	limit := (n + m + 1) / 2
+	offset := limit + 1
+	forward := make([]int, 2*limit+3)
+	backward := make([]int, 2*limit+3)
+
+	for d := 0; d <= limit; d++ {
+		// forward search, furthest x on each diagonal k = x - y
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			if odd && k >= delta-(d-1) && k <= delta+(d-1) && x+backward[offset+delta-k] >= n {
+				return startX, startY, x, y
+			}
+		}
+
+		// backward search on the reversed inputs, diagonal k corresponds to delta - k in the forward search
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+			if !odd && delta-k >= -d && delta-k <= d && x+forward[offset+delta-k] >= n {
+				return n - x, m - y, n - startX, m - startY
+			}
+		}
+	}
+
+	// unreachable, the searches always meet within (n+m+1)/2 steps
+	return 0, 0, 0, 0
+}
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestDiffLinesReconstructsBothSides(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 200; i++ {
+		a := randomLines(r, r.IntN(30))
+		b := randomLines(r, r.IntN(30))
+
+		var from, to []string
+		for _, op := range diffLines(a, b) {
+			if op.kind != '+' {
+				from = append(from, op.line)
+			}
+			if op.kind != '-' {
+				to = append(to, op.line)
+			}
+		}
+		if strings.Join(from, "") != strings.Join(a, "") || strings.Join(to, "") != strings.Join(b, "") {
+			t.Fatalf("edit script does not reconstruct the inputs\na: %q\nb: %q", a, b)
+		}
+	}
+}
+
+func TestDiffLinesIsMinimal(t *testing.T) {
+	a := splitLines("a\nb\nc\na\nb\nb\na\n")
+	b := splitLines("c\nb\na\nb\na\nc\n")
+
+	edits := 0
+	for _, op := range diffLines(a, b) {
+		if op.kind != ' ' {
+			edits++
+		}
+	}
+	if edits != 5 {
+		t.Errorf("expected 5 edits, got %d", edits)
+	}
+}
+
+func TestUnifiedDiffLargeNewFile(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&sb, "line %d\n", i)
+	}
+	content := []byte(sb.String())
+
+	allocs := testing.AllocsPerRun(1, func() {
+		UnifiedDiff("/dev/null", "new", nil, content)
+	})
+	if allocs > 100 {
+		t.Errorf("expected a one-sided diff to allocate little, got %.0f allocations", allocs)
+	}
+
+	diff := UnifiedDiff("/dev/null", "new", nil, content)
+	if !strings.HasPrefix(diff, "--- /dev/null\n+++ new\n@@ -0,0 +1,100000 @@\n+line 0\n") {
+		t.Errorf("unexpected diff header: %q", diff[:min(len(diff), 80)])
+	}
+}
+
+func TestUnifiedDiffLargeChangedFile(t *testing.T) {
+	var a, b strings.Builder
+	for i := 0; i < 4000; i++ {
+		fmt.Fprintf(&a, "old %d\n", i)
+		fmt.Fprintf(&b, "new %d\n", i)
+	}
+
+	diff := UnifiedDiff("a", "b", []byte(a.String()), []byte(b.String()))
+	if strings.Count(diff, "\n-old") != 4000 || strings.Count(diff, "\n+new") != 4000 {
+		t.Errorf("expected every line to be replaced")
+	}
+}
+
+func randomLines(r *rand.Rand, n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = string(rune('a'+r.IntN(4))) + "\n"
+	}
+	return lines
+}
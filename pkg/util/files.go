@@ -1,29 +1,57 @@
 package util
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"text/template"
 )
 
+// GetAllFiles returns the absolute paths of all files below root.
+// Files and directories matched by a .dotfilesignore file are skipped, matched directories are not walked.
+// Like .gitignore, patterns are relative to the directory of the ignore file and deeper ignore files take precedence.
 func GetAllFiles(root string) ([]string, error) {
 	var files []string
+	ignores := make(map[string]*Patterns) // relative directory -> patterns of its ignore file
 
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		// skip ignore files and ignored files and subtrees
+		if rel != "." && (filepath.Base(path) == IgnoreFile || isIgnored(ignores, rel, info.IsDir())) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-		if !info.IsDir() {
-			absPath, absPathErr := filepath.Abs(path)
-			if absPathErr != nil {
-				return fmt.Errorf("failed to get absolute path for %s: %w", path, absPathErr)
+		if info.IsDir() {
+			ignore, err := ReadIgnoreFile(path)
+			if err != nil {
+				return err
+			}
+			if ignore != nil {
+				ignores[rel] = ignore
 			}
-			files = append(files, absPath)
+			return nil
+		}
+
+		absPath, absPathErr := filepath.Abs(path)
+		if absPathErr != nil {
+			return fmt.Errorf("failed to get absolute path for %s: %w", path, absPathErr)
 		}
+		files = append(files, absPath)
 		return nil
 	})
 
@@ -34,143 +62,263 @@ func GetAllFiles(root string) ([]string, error) {
 	return files, nil
 }
 
+// isIgnored checks the path against the ignore files of its parent directories, from the root down
+func isIgnored(ignores map[string]*Patterns, rel string, isDir bool) bool {
+	ignored := false
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		dir := "."
+		if i > 0 {
+			dir = strings.Join(parts[:i], "/")
+		}
+		if matched, excluded := ignores[dir].matches(strings.Join(parts[i:], "/"), isDir); matched {
+			ignored = excluded
+		}
+	}
+	return ignored
+}
+
 func ResolvePath(path string) string {
+	return ExpandPath(path, "")
+}
+
+// ExpandPath replaces ~ with the home directory and expands environment variables, $HOME resolves to home if it is set
+func ExpandPath(path string, home string) string {
+	return ExpandPathVars(path, home, nil)
+}
+
+// ExpandPathVars expands the path like ExpandPath, vars take precedence over environment variables
+func ExpandPathVars(path string, home string, vars map[string]string) string {
 	// replace ~ with $HOME
 	path = strings.Replace(path, "~", "$HOME", 1)
 
-	// expand environment variables
-	path = os.ExpandEnv(path)
+	// expand variables
+	path = os.Expand(path, func(key string) string {
+		if key == "HOME" && home != "" {
+			return home
+		}
+		if v, ok := vars[key]; ok {
+			return v
+		}
+		return os.Getenv(key)
+	})
 
 	return path
 }
 
 func ResolvePathRelative(path, base string) string {
-	if strings.HasPrefix(path, "~") || filepath.IsAbs(path) {
-		return ResolvePath(path)
+	return ExpandPathRelative(path, base, "")
+}
+
+// ExpandPathRelative expands the path like ExpandPath, relative paths are resolved against base
+func ExpandPathRelative(path, base, home string) string {
+	return ExpandPathRelativeVars(path, base, home, nil)
+}
+
+// ExpandPathRelativeVars expands the path like ExpandPathVars, paths that are relative after the expansion are resolved against base
+func ExpandPathRelativeVars(path, base, home string, vars map[string]string) string {
+	path = ExpandPathVars(path, home, vars)
+	if filepath.IsAbs(path) {
+		return path
 	}
-	return ResolvePath(filepath.Join(base, path))
+	return filepath.Join(base, path)
 }
 
-func CreateParentDirectory(path string) error {
-	return os.MkdirAll(filepath.Dir(path), 0755)
+func CreateParentDirectory(fsys FS, path string) error {
+	return fsys.MkdirAll(filepath.Dir(path), 0755)
 }
 
-func LinkFile(source string, target string, dryRun bool, mode string, properties map[string]string) error {
-	if dryRun {
-		return nil
+// StageFile writes the copy, rendered template or symlink of the source to a temporary file next to the target.
+// The staged file can be moved into place with a rename, which is atomic as both are on the same filesystem.
+func StageFile(fsys FS, source string, target string, mode string, properties map[string]string) (string, error) {
+	if mode != "template" && mode != "copy" && mode != "symlink" {
+		return "", fmt.Errorf("invalid mode: %s (valid values: copy, symlink, template)", mode)
 	}
 
-	if err := CreateParentDirectory(target); err != nil {
-		return err
+	if err := CreateParentDirectory(fsys, target); err != nil {
+		return "", err
 	}
 
-	if _, err := os.Stat(target); err == nil {
-		return nil
+	// reserve a unique name, the file itself is created by the mode-specific function
+	staged, err := TempName(fsys, target, "dotfiles")
+	if err != nil {
+		return "", err
 	}
 
 	switch mode {
 	case "template":
-		return copyFileWithTemplate(source, target, properties)
+		err = copyFileWithTemplate(fsys, source, staged, properties)
 	case "copy":
-		return copyFile(source, target)
+		err = copyFile(fsys, source, staged)
 	case "symlink":
-		return createOrUpdateSymlink(source, target)
-	default:
-		return fmt.Errorf("invalid mode: %s (valid values: copy, symlink)", mode)
+		err = createSymlink(fsys, source, staged)
 	}
+	if err != nil {
+		_ = fsys.Remove(staged)
+		return "", err
+	}
+
+	return staged, nil
 }
 
-func copyFile(source string, target string) error {
-	src, err := os.Open(source)
+// ReadSource returns the content that copy or template mode would write to the target.
+func ReadSource(source string, mode string, properties map[string]string) ([]byte, error) {
+	content, err := os.ReadFile(source)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if mode != "template" {
+		return content, nil
 	}
-	defer src.Close()
 
-	tgt, err := os.Create(target)
+	return renderTemplate(content, properties)
+}
+
+// IsUpToDate checks if the target already matches what StageFile would produce for the source.
+func IsUpToDate(fsys FS, source string, target string, mode string, properties map[string]string) bool {
+	info, err := fsys.Lstat(target)
 	if err != nil {
+		return false
+	}
+
+	if mode == "symlink" {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return false
+		}
+		currentTarget, err := fsys.Readlink(target)
+		return err == nil && currentTarget == source
+	}
+
+	if !info.Mode().IsRegular() {
+		return false
+	}
+	expected, err := ReadSource(source, mode, properties)
+	if err != nil {
+		return false
+	}
+	actual, err := fsys.ReadFile(target)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(expected, actual)
+}
+
+// MoveFile moves a file, falling back to copy and remove if source and target are on different filesystems.
+func MoveFile(fsys FS, source string, target string) error {
+	if err := CreateParentDirectory(fsys, target); err != nil {
 		return err
 	}
-	defer tgt.Close()
 
-	if _, err := io.Copy(tgt, src); err != nil {
+	if err := fsys.Rename(source, target); err == nil {
+		return nil
+	}
+
+	info, err := fsys.Lstat(source)
+	if err != nil {
 		return err
 	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := fsys.Readlink(source)
+		if err != nil {
+			return err
+		}
+		if err := fsys.Symlink(link, target); err != nil {
+			return err
+		}
+	case info.Mode().IsRegular():
+		content, err := fsys.ReadFile(source)
+		if err != nil {
+			return err
+		}
+		if err := fsys.WriteFile(target, content, info.Mode().Perm()); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("failed to move %s: not a regular file or symlink", source)
+	}
 
-	return ensureExecutable(source, target)
+	return fsys.Remove(source)
 }
 
-func copyFileWithTemplate(source string, target string, data map[string]string) error {
-	src, err := os.Open(source)
+// HashFile returns the hex encoded sha256 checksum of the file content.
+func HashFile(fsys FS, path string) (string, error) {
+	content, err := fsys.ReadFile(path)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer src.Close()
+	return HashBytes(content), nil
+}
 
-	tgt, err := os.Create(target)
+// HashBytes returns the hex encoded sha256 checksum of the content.
+func HashBytes(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func copyFile(fsys FS, source string, target string) error {
+	content, err := os.ReadFile(source)
 	if err != nil {
 		return err
 	}
-	defer tgt.Close()
 
-	content, err := io.ReadAll(src)
-	if err != nil {
+	if err := fsys.WriteFile(target, content, 0644); err != nil {
 		return err
 	}
 
-	tmpl, err := template.New("template").Parse(string(content))
+	return EnsureExecutable(fsys, source, target)
+}
+
+func copyFileWithTemplate(fsys FS, source string, target string, data map[string]string) error {
+	rendered, err := ReadSource(source, "template", data)
 	if err != nil {
 		return err
 	}
-	if err := tmpl.Execute(tgt, data); err != nil {
+
+	if err := fsys.WriteFile(target, rendered, 0644); err != nil {
 		return err
 	}
 
-	return ensureExecutable(source, target)
+	return EnsureExecutable(fsys, source, target)
 }
 
-func createOrUpdateSymlink(source string, target string) error {
-	// check if symlink exists
-	linkInfo, err := os.Lstat(target)
-	if err == nil {
-		if linkInfo.Mode()&os.ModeSymlink != 0 { // is symlink
-			currentTarget, err := os.Readlink(target)
-			if err != nil {
-				return fmt.Errorf("failed to read existing symlink target: %w", err)
-			}
+// ParseTemplate parses the content as template, the name is used in error messages.
+func ParseTemplate(name string, content []byte) (*template.Template, error) {
+	return template.New(name).Parse(string(content))
+}
 
-			// skip if symlink points to the same target
-			if currentTarget == source {
-				return nil
-			}
+func renderTemplate(content []byte, data map[string]string) ([]byte, error) {
+	tmpl, err := ParseTemplate("template", content)
+	if err != nil {
+		return nil, err
+	}
 
-			// remove old symlink
-			if err := os.Remove(target); err != nil {
-				return fmt.Errorf("failed to remove existing symlink: %w", err)
-			}
-		} else { // is file/directory
-			if err := os.Remove(target); err != nil {
-				return fmt.Errorf("failed to remove existing file/directory: %w", err)
-			}
-		}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
 	}
 
-	// create symlink
-	if err := os.Symlink(source, target); err != nil {
+	return buf.Bytes(), nil
+}
+
+func createSymlink(fsys FS, source string, target string) error {
+	if err := fsys.Symlink(source, target); err != nil {
 		return fmt.Errorf("failed to create symlink: %w", err)
 	}
 
 	return nil
 }
 
-func ensureExecutable(source, target string) error {
+// EnsureExecutable adds the owner execute bit to the target if the source is executable.
+func EnsureExecutable(fsys FS, source, target string) error {
 	srcInfo, err := os.Stat(source)
 	if err != nil || srcInfo.Mode()&0100 == 0 {
 		return nil
 	}
-	tgtInfo, err := os.Stat(target)
+	tgtInfo, err := fsys.Stat(target)
 	if err != nil {
 		return err
 	}
-	return os.Chmod(target, tgtInfo.Mode()|0100)
+	return fsys.Chmod(target, tgtInfo.Mode()|0100)
 }
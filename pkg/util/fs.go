@@ -0,0 +1,356 @@
+package util
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS is the filesystem that targets, the state file, backups and generations are written to.
+// All paths are absolute paths as seen by the system the dotfiles are installed for, sources are always read from the OS.
+type FS interface {
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	ReadDir(name string) ([]fs.DirEntry, error)
+	MkdirAll(path string, perm fs.FileMode) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// NewFS returns the OS filesystem, or a filesystem rooted at root if it is not empty
+func NewFS(root string) FS {
+	if root == "" {
+		return OSFS{}
+	}
+	return &RootFS{Root: root}
+}
+
+// OSFS uses the paths as they are
+type OSFS struct{}
+
+func (OSFS) Stat(name string) (fs.FileInfo, error)  { return os.Stat(name) }
+func (OSFS) Lstat(name string) (fs.FileInfo, error) { return os.Lstat(name) }
+func (OSFS) ReadFile(name string) ([]byte, error)   { return os.ReadFile(name) }
+func (OSFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+func (OSFS) ReadDir(name string) ([]fs.DirEntry, error)   { return os.ReadDir(name) }
+func (OSFS) MkdirAll(path string, perm fs.FileMode) error { return os.MkdirAll(path, perm) }
+func (OSFS) Remove(name string) error                     { return os.Remove(name) }
+func (OSFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (OSFS) Symlink(oldname, newname string) error        { return os.Symlink(oldname, newname) }
+func (OSFS) Readlink(name string) (string, error)         { return os.Readlink(name) }
+func (OSFS) Chmod(name string, mode fs.FileMode) error    { return os.Chmod(name, mode) }
+
+// RootFS places all paths below the root directory on the OS filesystem, e.g. a scratch directory or an image build context.
+// Symlinks are created with the unmodified source path, so they resolve once the root becomes the real root.
+type RootFS struct {
+	Root string
+}
+
+func (r *RootFS) path(name string) string {
+	return filepath.Join(r.Root, filepath.Clean("/"+name))
+}
+
+func (r *RootFS) Stat(name string) (fs.FileInfo, error)  { return os.Stat(r.path(name)) }
+func (r *RootFS) Lstat(name string) (fs.FileInfo, error) { return os.Lstat(r.path(name)) }
+func (r *RootFS) ReadFile(name string) ([]byte, error)   { return os.ReadFile(r.path(name)) }
+func (r *RootFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(r.path(name), data, perm)
+}
+func (r *RootFS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(r.path(name)) }
+func (r *RootFS) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(r.path(path), perm)
+}
+func (r *RootFS) Remove(name string) error { return os.Remove(r.path(name)) }
+func (r *RootFS) Rename(oldpath, newpath string) error {
+	return os.Rename(r.path(oldpath), r.path(newpath))
+}
+func (r *RootFS) Symlink(oldname, newname string) error     { return os.Symlink(oldname, r.path(newname)) }
+func (r *RootFS) Readlink(name string) (string, error)      { return os.Readlink(r.path(name)) }
+func (r *RootFS) Chmod(name string, mode fs.FileMode) error { return os.Chmod(r.path(name), mode) }
+
+// MemFS keeps all files in memory, it is meant for tests and previews
+type MemFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	data    []byte
+	mode    fs.FileMode
+	link    string
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{nodes: map[string]*memNode{
+		"/": {mode: fs.ModeDir | 0755, modTime: time.Now()},
+	}}
+}
+
+// resolve follows symlinks of the last path element
+func (m *MemFS) resolve(name string) (string, *memNode, error) {
+	name = filepath.Clean("/" + name)
+	for i := 0; i < 40; i++ {
+		n, ok := m.nodes[name]
+		if !ok {
+			return name, nil, fs.ErrNotExist
+		}
+		if n.mode&fs.ModeSymlink == 0 {
+			return name, n, nil
+		}
+		if filepath.IsAbs(n.link) {
+			name = filepath.Clean(n.link)
+		} else {
+			name = filepath.Join(filepath.Dir(name), n.link)
+		}
+	}
+	return name, nil, fmt.Errorf("too many levels of symbolic links")
+}
+
+// parentDir ensures the parent of name exists and is a directory
+func (m *MemFS) parentDir(name string) error {
+	_, parent, err := m.resolve(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	if !parent.mode.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+	return nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	resolved, n, err := m.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return &memFileInfo{name: filepath.Base(resolved), node: n}, nil
+}
+
+func (m *MemFS) Lstat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean("/" + name)
+	n, ok := m.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFileInfo{name: filepath.Base(name), node: n}, nil
+}
+
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, n, err := m.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+	return slices.Clone(n.data), nil
+}
+
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	resolved, n, err := m.resolve(name)
+	if err == nil {
+		if n.mode.IsDir() {
+			return &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("is a directory")}
+		}
+		n.data = slices.Clone(data)
+		n.modTime = time.Now()
+		return nil
+	}
+	if err := m.parentDir(resolved); err != nil {
+		return &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	m.nodes[resolved] = &memNode{data: slices.Clone(data), mode: perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	resolved, n, err := m.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if !n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdirent", Path: name, Err: fmt.Errorf("not a directory")}
+	}
+
+	var entries []fs.DirEntry
+	for p, child := range m.nodes {
+		if p != resolved && filepath.Dir(p) == resolved {
+			entries = append(entries, fs.FileInfoToDirEntry(&memFileInfo{name: filepath.Base(p), node: child}))
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func (m *MemFS) MkdirAll(path string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path = filepath.Clean("/" + path)
+	var missing []string
+	for dir := path; ; dir = filepath.Dir(dir) {
+		_, n, err := m.resolve(dir)
+		if err == nil {
+			if !n.mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: dir, Err: fmt.Errorf("not a directory")}
+			}
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for _, dir := range missing {
+		m.nodes[dir] = &memNode{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean("/" + name)
+	n, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.mode.IsDir() {
+		for p := range m.nodes {
+			if p != name && filepath.Dir(p) == name {
+				return &fs.PathError{Op: "remove", Path: name, Err: fmt.Errorf("directory not empty")}
+			}
+		}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath = filepath.Clean("/" + oldpath)
+	newpath = filepath.Clean("/" + newpath)
+	n, ok := m.nodes[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if err := m.parentDir(newpath); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	if existing, ok := m.nodes[newpath]; ok && existing.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+	}
+
+	delete(m.nodes, oldpath)
+	m.nodes[newpath] = n
+	if n.mode.IsDir() {
+		prefix := oldpath + string(filepath.Separator)
+		moved := make(map[string]*memNode)
+		for p, child := range m.nodes {
+			if strings.HasPrefix(p, prefix) {
+				moved[filepath.Join(newpath, strings.TrimPrefix(p, prefix))] = child
+				delete(m.nodes, p)
+			}
+		}
+		maps.Copy(m.nodes, moved)
+	}
+	return nil
+}
+
+func (m *MemFS) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newname = filepath.Clean("/" + newname)
+	if _, ok := m.nodes[newname]; ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	if err := m.parentDir(newname); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	m.nodes[newname] = &memNode{mode: fs.ModeSymlink | 0777, link: oldname, modTime: time.Now()}
+	return nil
+}
+
+func (m *MemFS) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean("/" + name)
+	n, ok := m.nodes[name]
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fmt.Errorf("invalid argument")}
+	}
+	return n.link, nil
+}
+
+func (m *MemFS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, n, err := m.resolve(name)
+	if err != nil {
+		return &fs.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	n.mode = n.mode.Type() | mode.Perm()
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	node *memNode
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return int64(len(i.node.data)) }
+func (i *memFileInfo) Mode() fs.FileMode  { return i.node.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.node.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.node.mode.IsDir() }
+func (i *memFileInfo) Sys() any           { return nil }
+
+// TempName returns an unused name next to the target, matching the pattern of os.CreateTemp
+func TempName(fsys FS, target string, suffix string) (string, error) {
+	dir := filepath.Dir(target)
+	for i := 0; i < 100; i++ {
+		name := filepath.Join(dir, fmt.Sprintf(".%s.%s-%d", filepath.Base(target), suffix, rand.Uint32()))
+		if _, err := fsys.Lstat(name); os.IsNotExist(err) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find a temporary name for %s", target)
+}
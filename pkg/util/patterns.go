@@ -0,0 +1,183 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile lists the files of a directory that are never installed, one pattern per line
+const IgnoreFile = ".dotfilesignore"
+
+// Patterns matches slash separated paths relative to a directory with gitignore-like patterns.
+//
+//   - `*.md` without a slash matches the name in any subdirectory, `docs/*.md` is relative to the directory
+//   - `**` matches any number of directories, a trailing `/` only matches directories
+//   - `!` negates a pattern, the last matching pattern wins
+//   - `regex:` matches the relative path with a regular expression instead of a glob
+type Patterns struct {
+	patterns []pattern
+}
+
+type pattern struct {
+	negate   bool
+	dirOnly  bool
+	segments []string       // glob split at /
+	regex    *regexp.Regexp // instead of the glob
+}
+
+// PatternError is returned for patterns that can not be parsed
+type PatternError struct {
+	Pattern string
+	Err     error
+}
+
+func (e *PatternError) Error() string {
+	return fmt.Sprintf("invalid pattern %q: %v", e.Pattern, e.Err)
+}
+
+func (e *PatternError) Unwrap() error {
+	return e.Err
+}
+
+// ParsePatterns parses the patterns, empty lines and lines starting with # are skipped
+func ParsePatterns(lines []string) (*Patterns, error) {
+	ps := &Patterns{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := pattern{}
+		expr := line
+		if strings.HasPrefix(expr, "!") {
+			p.negate = true
+			expr = expr[1:]
+		}
+
+		if re, ok := strings.CutPrefix(expr, "regex:"); ok {
+			regex, err := regexp.Compile(re)
+			if err != nil {
+				return nil, &PatternError{Pattern: line, Err: err}
+			}
+			p.regex = regex
+			ps.patterns = append(ps.patterns, p)
+			continue
+		}
+
+		if strings.HasSuffix(expr, "/") {
+			p.dirOnly = true
+			expr = strings.TrimRight(expr, "/")
+		}
+		// patterns without a slash match in any subdirectory, a leading slash anchors them to the directory
+		if !strings.Contains(expr, "/") {
+			expr = "**/" + expr
+		}
+		expr = strings.TrimPrefix(expr, "/")
+		if expr == "" {
+			return nil, &PatternError{Pattern: line, Err: errors.New("empty pattern")}
+		}
+
+		p.segments = strings.Split(expr, "/")
+		for _, seg := range p.segments {
+			if _, err := path.Match(seg, ""); err != nil {
+				return nil, &PatternError{Pattern: line, Err: err}
+			}
+		}
+		ps.patterns = append(ps.patterns, p)
+	}
+
+	return ps, nil
+}
+
+// ReadIgnoreFile parses the ignore file of the directory, nil if the directory has none
+func ReadIgnoreFile(dir string) (*Patterns, error) {
+	file := filepath.Join(dir, IgnoreFile)
+	content, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := ParsePatterns(strings.Split(string(content), "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return ps, nil
+}
+
+// Match reports whether the path is matched by the patterns, without checking its parent directories
+func (ps *Patterns) Match(name string, isDir bool) bool {
+	_, excluded := ps.matches(name, isDir)
+	return excluded
+}
+
+// matches reports whether any pattern matches the path and whether the last matching pattern excludes it
+func (ps *Patterns) matches(name string, isDir bool) (matched bool, excluded bool) {
+	if ps == nil {
+		return false, false
+	}
+
+	for _, p := range ps.patterns {
+		if p.match(name, isDir) {
+			matched, excluded = true, !p.negate
+		}
+	}
+	return matched, excluded
+}
+
+// Excludes reports whether the file or one of its parent directories is matched by the patterns.
+// Like in gitignore, files in a matched directory can not be included again by a negated pattern.
+func (ps *Patterns) Excludes(name string) bool {
+	if ps == nil || name == ".." || strings.HasPrefix(name, "../") {
+		return false
+	}
+
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		if ps.Match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return ps.Match(name, false)
+}
+
+func (p pattern) match(name string, isDir bool) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(name)
+	}
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return matchSegments(p.segments, strings.Split(name, "/"))
+}
+
+// matchSegments matches the path segments against the glob segments, ** matches zero or more segments
+func matchSegments(globs []string, names []string) bool {
+	if len(globs) == 0 {
+		return len(names) == 0
+	}
+	if globs[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if matchSegments(globs[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(globs[0], names[0]); !ok {
+		return false
+	}
+	return matchSegments(globs[1:], names[1:])
+}